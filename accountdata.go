@@ -0,0 +1,53 @@
+package sdnclient
+
+import "context"
+
+// GetAccountData decodes the global account data of the given type into out.
+func (cli *Client) GetAccountData(eventType string, out interface{}) (err error) {
+	return cli.GetAccountDataWithContext(context.Background(), eventType, out)
+}
+
+// GetAccountDataWithContext is like GetAccountData but with a context.
+func (cli *Client) GetAccountDataWithContext(ctx context.Context, eventType string, out interface{}) (err error) {
+	urlPath := cli.BuildURL("user", cli.getUserID(), "account_data", eventType)
+	err = cli.MakeRequestWithContext(ctx, "GET", urlPath, nil, out)
+	return
+}
+
+// SetAccountData sets the global account data of the given type.
+// content should be a pointer to something that can be encoded as JSON using json.Marshal.
+func (cli *Client) SetAccountData(eventType string, content interface{}) (err error) {
+	return cli.SetAccountDataWithContext(context.Background(), eventType, content)
+}
+
+// SetAccountDataWithContext is like SetAccountData but with a context.
+func (cli *Client) SetAccountDataWithContext(ctx context.Context, eventType string, content interface{}) (err error) {
+	urlPath := cli.BuildURL("user", cli.getUserID(), "account_data", eventType)
+	err = cli.MakeRequestWithContext(ctx, "PUT", urlPath, content, nil)
+	return
+}
+
+// GetRoomAccountData decodes the account data of the given type for a room into out.
+func (cli *Client) GetRoomAccountData(roomID, eventType string, out interface{}) (err error) {
+	return cli.GetRoomAccountDataWithContext(context.Background(), roomID, eventType, out)
+}
+
+// GetRoomAccountDataWithContext is like GetRoomAccountData but with a context.
+func (cli *Client) GetRoomAccountDataWithContext(ctx context.Context, roomID, eventType string, out interface{}) (err error) {
+	urlPath := cli.BuildURL("user", cli.getUserID(), "rooms", roomID, "account_data", eventType)
+	err = cli.MakeRequestWithContext(ctx, "GET", urlPath, nil, out)
+	return
+}
+
+// SetRoomAccountData sets the account data of the given type for a room.
+// content should be a pointer to something that can be encoded as JSON using json.Marshal.
+func (cli *Client) SetRoomAccountData(roomID, eventType string, content interface{}) (err error) {
+	return cli.SetRoomAccountDataWithContext(context.Background(), roomID, eventType, content)
+}
+
+// SetRoomAccountDataWithContext is like SetRoomAccountData but with a context.
+func (cli *Client) SetRoomAccountDataWithContext(ctx context.Context, roomID, eventType string, content interface{}) (err error) {
+	urlPath := cli.BuildURL("user", cli.getUserID(), "rooms", roomID, "account_data", eventType)
+	err = cli.MakeRequestWithContext(ctx, "PUT", urlPath, content, nil)
+	return
+}
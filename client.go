@@ -1,16 +1,19 @@
 package sdnclient
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	ethereumcrypto "github.com/ethereum/go-ethereum/crypto"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,8 +22,19 @@ type Config struct {
 	Endpoint      string `yaml:"endpoint"`
 	WalletAddress string `yaml:"wallet_address"`
 	PrivateKey    string `yaml:"private_key"`
-	UserID        string `yaml:"user_id"`
-	AccessToken   string `yaml:"access_token"`
+	// KeystorePath is a V3 keystore file holding the encrypted private key, used if PrivateKey is empty.
+	// Its passphrase is read from the KeystorePassphraseEnv environment variable, from the KeystorePassphraseFile
+	// file or, if neither is set, prompted for on the terminal.
+	KeystorePath           string `yaml:"keystore_path,omitempty"`
+	KeystorePassphraseEnv  string `yaml:"keystore_passphrase_env,omitempty"`
+	KeystorePassphraseFile string `yaml:"keystore_passphrase_file,omitempty"`
+	RemoteSigner           string `yaml:"remote_signer,omitempty"` // JSON-RPC endpoint signing for WalletAddress, used if there is no key
+	DID                    string `yaml:"did,omitempty"`           // DID to log in with, set to the DID used after login
+	CreateDID              bool   `yaml:"create_did,omitempty"`    // Create and save a DID on login if the wallet has none
+	UserID                 string `yaml:"user_id"`
+	AccessToken            string `yaml:"access_token"`
+	DeviceID               string `yaml:"device_id,omitempty"`  // Device to log in with, set to the device used after login
+	StorePath              string `yaml:"store_path,omitempty"` // Directory of a FileStore. If empty, an InMemoryStore is used
 }
 
 // Client represents a SDN client
@@ -29,42 +43,172 @@ type Client struct {
 	AccessToken   string
 	Endpoint      string
 	WalletAddress string
-	PrivateKey    *ecdsa.PrivateKey
+	PrivateKey    *ecdsa.PrivateKey // Only set if the client was created with an in-memory key.
+	Signer        Signer            // Signs the login message, used by automatic re-login.
+	DID           string            // The DID the client logged in with, reused by automatic re-login.
+	DeviceID      string            // The device the client logged in with, reused by automatic re-login.
 	httpClient    *http.Client
 	PathPrefix    string
-	Syncer        Syncer
-	Store         Storer
-	syncingMutex  sync.Mutex // protects syncingID
-	syncingID     uint32     // Identifies the current Sync. Only one Sync can be active at any given time.
+	// MediaPathPrefix is the path prefix of the media repository, used by UploadMedia, DownloadMedia and Thumbnail.
+	MediaPathPrefix string
+	Syncer          Syncer
+	Store           Storer
+	RetryPolicy     *RetryPolicy // How rate-limited requests are retried. nil disables retries.
+	// AutoRelogin makes requests failing with M_UNKNOWN_TOKEN log in again with Signer and be replayed once.
+	AutoRelogin bool
+	// SyncPresence is the presence set by Sync while syncing: "online", "offline" or "unavailable".
+	// If empty, syncing sets the user online.
+	SyncPresence string
+	// OnTokenRefreshed, if set, is called after an automatic re-login with its result, e.g. to persist the new
+	// user ID, access token, device ID and DID.
+	OnTokenRefreshed func(res *LoginResult)
+
+	credentialsMutex sync.RWMutex       // protects UserID, AccessToken, DID and DeviceID once the client is in use
+	loginMutex       sync.Mutex         // serializes automatic re-logins
+	syncingMutex     sync.Mutex         // protects syncingID and syncingCancel
+	syncingID        uint32             // Identifies the current Sync. Only one Sync can be active at any given time.
+	syncingCancel    context.CancelFunc // Aborts the in-flight request of the current Sync.
 }
 
 // NewClient create a new SDN client with the given configuration
 func NewClient(config *Config) (*Client, error) {
-	privateKey, err := ethereumcrypto.HexToECDSA(config.PrivateKey)
-	if err != nil {
-		return nil, err
+	var signer Signer
+	switch {
+	case config.PrivateKey != "":
+		privateKeySigner, err := NewPrivateKeySignerFromHex(config.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		signer = privateKeySigner
+	case config.KeystorePath != "":
+		passphrase, err := config.keystorePassphrase()
+		if err != nil {
+			return nil, err
+		}
+		keystoreSigner, err := NewKeystoreSigner(config.KeystorePath, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		signer = keystoreSigner
+	case config.RemoteSigner != "":
+		if config.WalletAddress == "" {
+			return nil, errors.New("remote_signer requires wallet_address")
+		}
+		signer = NewRemoteSigner(config.RemoteSigner, config.WalletAddress)
+	default:
+		return nil, errors.New("no private_key, keystore_path or remote_signer configured")
+	}
+	return NewClientWithSigner(config, signer)
+}
+
+// NewClientWithSigner create a new SDN client with the given configuration, logging in with signer.
+// Config.PrivateKey, Config.KeystorePath and Config.RemoteSigner are ignored. If Config.WalletAddress is set,
+// it must be the address of signer.
+func NewClientWithSigner(config *Config, signer Signer) (*Client, error) {
+	if config.WalletAddress == "" {
+		config.WalletAddress = signer.Address()
+	} else if !strings.EqualFold(config.WalletAddress, signer.Address()) {
+		return nil, fmt.Errorf("wallet_address %s doesn't match the address %s of the signing key",
+			config.WalletAddress, signer.Address())
 	}
 	if len(config.AccessToken) == 0 || len(config.UserID) == 0 {
-		accessToken, userID, err := Login(config.Endpoint, config.WalletAddress, privateKey)
+		res, err := loginWithOptions(context.Background(), config.Endpoint, config.WalletAddress, signer,
+			&LoginOptions{DID: config.DID, CreateDID: config.CreateDID, DeviceID: config.DeviceID})
 		if err != nil {
 			return nil, err
 		}
-		log.Infof("login userID: %s, accessToken: %s", userID, accessToken)
-		config.AccessToken = accessToken
-		config.UserID = userID
+		log.Infof("login userID: %s, deviceID: %s, DID: %s (%s)", res.UserID, res.DeviceID, res.DID, res.Path)
+		config.AccessToken = res.AccessToken
+		config.UserID = res.UserID
+		config.DID = res.DID
+		config.DeviceID = res.DeviceID
+	}
+	var privateKey *ecdsa.PrivateKey
+	if privateKeySigner, ok := signer.(*PrivateKeySigner); ok {
+		privateKey = privateKeySigner.key
 	}
-	store := NewInMemoryStore()
-	return &Client{
-		UserID:        config.UserID,
-		AccessToken:   config.AccessToken,
-		Endpoint:      config.Endpoint,
-		WalletAddress: config.WalletAddress,
-		PrivateKey:    privateKey,
-		httpClient:    http.DefaultClient,
-		PathPrefix:    "/_api/client/r0",
-		Syncer:        NewDefaultSyncer(config.UserID, store),
-		Store:         store,
-	}, nil
+	var store Storer = NewInMemoryStore()
+	if config.StorePath != "" {
+		fileStore, err := NewFileStore(config.StorePath)
+		if err != nil {
+			return nil, err
+		}
+		store = fileStore
+	}
+	syncer := NewDefaultSyncer(config.UserID, store)
+	cli := &Client{
+		UserID:          config.UserID,
+		AccessToken:     config.AccessToken,
+		Endpoint:        config.Endpoint,
+		WalletAddress:   config.WalletAddress,
+		PrivateKey:      privateKey,
+		Signer:          signer,
+		DID:             config.DID,
+		DeviceID:        config.DeviceID,
+		httpClient:      http.DefaultClient,
+		PathPrefix:      "/_api/client/r0",
+		MediaPathPrefix: "/_api/media/r0",
+		Syncer:          syncer,
+		Store:           store,
+		RetryPolicy:     NewDefaultRetryPolicy(),
+		AutoRelogin:     true,
+	}
+	syncer.Client = cli
+	return cli, nil
+}
+
+// Credentials returns the current user ID and access token. Use it instead of reading the UserID and
+// AccessToken fields when AutoRelogin may swap them from another goroutine.
+func (cli *Client) Credentials() (userID, accessToken string) {
+	cli.credentialsMutex.RLock()
+	defer cli.credentialsMutex.RUnlock()
+	return cli.UserID, cli.AccessToken
+}
+
+// SetCredentials replaces the user ID and access token used by the client.
+func (cli *Client) SetCredentials(userID, accessToken string) {
+	cli.credentialsMutex.Lock()
+	defer cli.credentialsMutex.Unlock()
+	cli.UserID = userID
+	cli.AccessToken = accessToken
+}
+
+func (cli *Client) getUserID() string {
+	userID, _ := cli.Credentials()
+	return userID
+}
+
+func (cli *Client) getAccessToken() string {
+	_, accessToken := cli.Credentials()
+	return accessToken
+}
+
+// relogin runs the DID login flow again to replace failedToken. If another goroutine has already replaced
+// failedToken, nothing is done.
+func (cli *Client) relogin(ctx context.Context, failedToken string) error {
+	cli.loginMutex.Lock()
+	defer cli.loginMutex.Unlock()
+	if cli.getAccessToken() != failedToken {
+		return nil
+	}
+	cli.credentialsMutex.RLock()
+	opts := &LoginOptions{DID: cli.DID, DeviceID: cli.DeviceID}
+	cli.credentialsMutex.RUnlock()
+	res, err := loginWithOptions(ctx, cli.Endpoint, cli.WalletAddress, cli.Signer, opts)
+	if err != nil {
+		return err
+	}
+	log.Infof("re-login userID: %s, deviceID: %s, DID: %s (%s)", res.UserID, res.DeviceID, res.DID, res.Path)
+	cli.credentialsMutex.Lock()
+	cli.UserID = res.UserID
+	cli.AccessToken = res.AccessToken
+	cli.DID = res.DID
+	cli.DeviceID = res.DeviceID
+	cli.credentialsMutex.Unlock()
+	if cli.OnTokenRefreshed != nil {
+		cli.OnTokenRefreshed(res)
+	}
+	return nil
 }
 
 // BuildURL builds a URL to send request to
@@ -85,85 +229,176 @@ func (cli *Client) BuildURLWithQuery(urlPath []string, urlQuery map[string]strin
 
 // GetJoinedRooms GetJoinedRooms
 func (cli *Client) GetJoinedRooms() (resp *RespJoinedRooms, err error) {
+	return cli.GetJoinedRoomsWithContext(context.Background())
+}
+
+// GetJoinedRoomsWithContext is like GetJoinedRooms but with a context.
+func (cli *Client) GetJoinedRoomsWithContext(ctx context.Context) (resp *RespJoinedRooms, err error) {
 	urlPath := cli.BuildURL("joined_rooms")
-	err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	err = cli.MakeRequestWithContext(ctx, "GET", urlPath, nil, &resp)
 	return
 }
 
 // CreateRoom creates a new SDN room
 func (cli *Client) CreateRoom(req *ReqCreateRoom) (resp *RespCreateRoom, err error) {
+	return cli.CreateRoomWithContext(context.Background(), req)
+}
+
+// CreateRoomWithContext is like CreateRoom but with a context.
+func (cli *Client) CreateRoomWithContext(ctx context.Context, req *ReqCreateRoom) (resp *RespCreateRoom, err error) {
 	urlPath := cli.BuildURL("createRoom")
-	err = cli.MakeRequest("POST", urlPath, req, &resp)
+	err = cli.MakeRequestWithContext(ctx, "POST", urlPath, req, &resp)
 	return
 }
 
 // JoinRoom joins the client to a room ID or alias
 func (cli *Client) JoinRoom(roomIDorAlias string) (resp *RespJoinRoom, err error) {
+	return cli.JoinRoomWithContext(context.Background(), roomIDorAlias)
+}
+
+// JoinRoomWithContext is like JoinRoom but with a context.
+func (cli *Client) JoinRoomWithContext(ctx context.Context, roomIDorAlias string) (resp *RespJoinRoom, err error) {
 	u := cli.BuildURL("join", roomIDorAlias)
-	err = cli.MakeRequest("POST", u, struct{}{}, &resp)
+	err = cli.MakeRequestWithContext(ctx, "POST", u, struct{}{}, &resp)
 	return
 }
 
 // LeaveRoom leaves the given room
 func (cli *Client) LeaveRoom(roomID string) (resp *RespLeaveRoom, err error) {
+	return cli.LeaveRoomWithContext(context.Background(), roomID)
+}
+
+// LeaveRoomWithContext is like LeaveRoom but with a context.
+func (cli *Client) LeaveRoomWithContext(ctx context.Context, roomID string) (resp *RespLeaveRoom, err error) {
 	u := cli.BuildURL("rooms", roomID, "leave")
-	err = cli.MakeRequest("POST", u, struct{}{}, &resp)
+	err = cli.MakeRequestWithContext(ctx, "POST", u, struct{}{}, &resp)
 	return
 }
 
 // InviteUser invites a user to a room
 func (cli *Client) InviteUser(roomID string, req *ReqInviteUser) (resp *RespInviteUser, err error) {
+	return cli.InviteUserWithContext(context.Background(), roomID, req)
+}
+
+// InviteUserWithContext is like InviteUser but with a context.
+func (cli *Client) InviteUserWithContext(ctx context.Context, roomID string, req *ReqInviteUser) (resp *RespInviteUser, err error) {
 	u := cli.BuildURL("rooms", roomID, "invite")
-	err = cli.MakeRequest("POST", u, req, &resp)
+	err = cli.MakeRequestWithContext(ctx, "POST", u, req, &resp)
 	return
 }
 
 // KickUser kicks a user from a room
 func (cli *Client) KickUser(roomID string, req *ReqKickUser) (resp *RespKickUser, err error) {
+	return cli.KickUserWithContext(context.Background(), roomID, req)
+}
+
+// KickUserWithContext is like KickUser but with a context.
+func (cli *Client) KickUserWithContext(ctx context.Context, roomID string, req *ReqKickUser) (resp *RespKickUser, err error) {
 	u := cli.BuildURL("rooms", roomID, "kick")
-	err = cli.MakeRequest("POST", u, req, &resp)
+	err = cli.MakeRequestWithContext(ctx, "POST", u, req, &resp)
+	return
+}
+
+// BanUser bans a user from a room
+func (cli *Client) BanUser(roomID string, req *ReqBanUser) (resp *RespBanUser, err error) {
+	return cli.BanUserWithContext(context.Background(), roomID, req)
+}
+
+// BanUserWithContext is like BanUser but with a context.
+func (cli *Client) BanUserWithContext(ctx context.Context, roomID string, req *ReqBanUser) (resp *RespBanUser, err error) {
+	u := cli.BuildURL("rooms", roomID, "ban")
+	err = cli.MakeRequestWithContext(ctx, "POST", u, req, &resp)
+	return
+}
+
+// UnbanUser unbans a user from a room
+func (cli *Client) UnbanUser(roomID string, req *ReqUnbanUser) (resp *RespUnbanUser, err error) {
+	return cli.UnbanUserWithContext(context.Background(), roomID, req)
+}
+
+// UnbanUserWithContext is like UnbanUser but with a context.
+func (cli *Client) UnbanUserWithContext(ctx context.Context, roomID string, req *ReqUnbanUser) (resp *RespUnbanUser, err error) {
+	u := cli.BuildURL("rooms", roomID, "unban")
+	err = cli.MakeRequestWithContext(ctx, "POST", u, req, &resp)
+	return
+}
+
+// ForgetRoom forgets a room which the client has left, so that it is no longer returned by the server
+func (cli *Client) ForgetRoom(roomID string) (resp *RespForgetRoom, err error) {
+	return cli.ForgetRoomWithContext(context.Background(), roomID)
+}
+
+// ForgetRoomWithContext is like ForgetRoom but with a context.
+func (cli *Client) ForgetRoomWithContext(ctx context.Context, roomID string) (resp *RespForgetRoom, err error) {
+	u := cli.BuildURL("rooms", roomID, "forget")
+	err = cli.MakeRequestWithContext(ctx, "POST", u, struct{}{}, &resp)
 	return
 }
 
 // JoinedMembers returns a map of joined room members
 func (cli *Client) JoinedMembers(roomID string) (resp *RespJoinedMembers, err error) {
+	return cli.JoinedMembersWithContext(context.Background(), roomID)
+}
+
+// JoinedMembersWithContext is like JoinedMembers but with a context.
+func (cli *Client) JoinedMembersWithContext(ctx context.Context, roomID string) (resp *RespJoinedMembers, err error) {
 	u := cli.BuildURL("rooms", roomID, "joined_members")
-	err = cli.MakeRequest("GET", u, nil, &resp)
+	err = cli.MakeRequestWithContext(ctx, "GET", u, nil, &resp)
 	return
 }
 
 // Logout the current user.
 func (cli *Client) Logout() (resp *RespLogout, err error) {
+	return cli.LogoutWithContext(context.Background())
+}
+
+// LogoutWithContext is like Logout but with a context.
+func (cli *Client) LogoutWithContext(ctx context.Context) (resp *RespLogout, err error) {
 	urlPath := cli.BuildURL("logout")
-	err = cli.MakeRequest("POST", urlPath, nil, &resp)
+	err = cli.MakeRequestWithContext(ctx, "POST", urlPath, nil, &resp)
 	return
 }
 
 // GetDisplayName returns the client's display name.
 func (cli *Client) GetDisplayName() (resp *RespUserDisplayName, err error) {
-	urlPath := cli.BuildURL("profile", cli.UserID, "displayname")
-	err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	return cli.GetDisplayNameWithContext(context.Background())
+}
+
+// GetDisplayNameWithContext is like GetDisplayName but with a context.
+func (cli *Client) GetDisplayNameWithContext(ctx context.Context) (resp *RespUserDisplayName, err error) {
+	urlPath := cli.BuildURL("profile", cli.getUserID(), "displayname")
+	err = cli.MakeRequestWithContext(ctx, "GET", urlPath, nil, &resp)
 	return
 }
 
 // SetDisplayName sets the client's profile display name.
 func (cli *Client) SetDisplayName(displayName string) (err error) {
-	urlPath := cli.BuildURL("profile", cli.UserID, "displayname")
+	return cli.SetDisplayNameWithContext(context.Background(), displayName)
+}
+
+// SetDisplayNameWithContext is like SetDisplayName but with a context.
+func (cli *Client) SetDisplayNameWithContext(ctx context.Context, displayName string) (err error) {
+	urlPath := cli.BuildURL("profile", cli.getUserID(), "displayname")
 	s := struct {
 		DisplayName string `json:"displayname"`
 	}{displayName}
-	err = cli.MakeRequest("PUT", urlPath, &s, nil)
+	err = cli.MakeRequestWithContext(ctx, "PUT", urlPath, &s, nil)
 	return
 }
 
 // GetAvatarURL gets the client's avatar URL.
 func (cli *Client) GetAvatarURL() (avatarUrl string, err error) {
-	urlPath := cli.BuildURL("profile", cli.UserID, "avatar_url")
+	return cli.GetAvatarURLWithContext(context.Background())
+}
+
+// GetAvatarURLWithContext is like GetAvatarURL but with a context.
+func (cli *Client) GetAvatarURLWithContext(ctx context.Context) (avatarUrl string, err error) {
+	urlPath := cli.BuildURL("profile", cli.getUserID(), "avatar_url")
 	s := struct {
 		AvatarURL string `json:"avatar_url"`
 	}{}
 
-	err = cli.MakeRequest("GET", urlPath, nil, &s)
+	err = cli.MakeRequestWithContext(ctx, "GET", urlPath, nil, &s)
 	if err != nil {
 		return "", err
 	}
@@ -172,60 +407,201 @@ func (cli *Client) GetAvatarURL() (avatarUrl string, err error) {
 
 // SetAvatarURL sets the client's avatar URL.
 func (cli *Client) SetAvatarURL(url string) (err error) {
-	urlPath := cli.BuildURL("profile", cli.UserID, "avatar_url")
+	return cli.SetAvatarURLWithContext(context.Background(), url)
+}
+
+// SetAvatarURLWithContext is like SetAvatarURL but with a context.
+func (cli *Client) SetAvatarURLWithContext(ctx context.Context, url string) (err error) {
+	urlPath := cli.BuildURL("profile", cli.getUserID(), "avatar_url")
 	s := struct {
 		AvatarURL string `json:"avatar_url"`
 	}{url}
-	err = cli.MakeRequest("PUT", urlPath, &s, nil)
+	err = cli.MakeRequestWithContext(ctx, "PUT", urlPath, &s, nil)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// GetDevices returns the devices of the current user.
+func (cli *Client) GetDevices() (resp *RespDevices, err error) {
+	return cli.GetDevicesWithContext(context.Background())
+}
+
+// GetDevicesWithContext is like GetDevices but with a context.
+func (cli *Client) GetDevicesWithContext(ctx context.Context) (resp *RespDevices, err error) {
+	urlPath := cli.BuildURL("devices")
+	err = cli.MakeRequestWithContext(ctx, "GET", urlPath, nil, &resp)
+	return
+}
+
+// GetDevice returns the given device of the current user.
+func (cli *Client) GetDevice(deviceID string) (resp *RespDevice, err error) {
+	return cli.GetDeviceWithContext(context.Background(), deviceID)
+}
+
+// GetDeviceWithContext is like GetDevice but with a context.
+func (cli *Client) GetDeviceWithContext(ctx context.Context, deviceID string) (resp *RespDevice, err error) {
+	urlPath := cli.BuildURL("devices", deviceID)
+	err = cli.MakeRequestWithContext(ctx, "GET", urlPath, nil, &resp)
+	return
+}
+
+// SetDeviceDisplayName renames the given device of the current user.
+func (cli *Client) SetDeviceDisplayName(deviceID, displayName string) (err error) {
+	return cli.SetDeviceDisplayNameWithContext(context.Background(), deviceID, displayName)
+}
+
+// SetDeviceDisplayNameWithContext is like SetDeviceDisplayName but with a context.
+func (cli *Client) SetDeviceDisplayNameWithContext(ctx context.Context, deviceID, displayName string) (err error) {
+	urlPath := cli.BuildURL("devices", deviceID)
+	err = cli.MakeRequestWithContext(ctx, "PUT", urlPath, &ReqSetDeviceDisplayName{DisplayName: displayName}, nil)
+	return
+}
+
+// DeleteDevice deletes the given device of the current user, logging it out.
+//
+// Deleting devices requires user-interactive authentication: if req.Auth is missing or incomplete, the
+// returned error is accompanied by the auth flows, params and session. Call again with req.Auth filled in,
+// e.g. {"type": ..., "session": resp.Session, ...}.
+func (cli *Client) DeleteDevice(deviceID string, req *ReqDeleteDevice) (resp *RespUserInteractive, err error) {
+	return cli.DeleteDeviceWithContext(context.Background(), deviceID, req)
+}
+
+// DeleteDeviceWithContext is like DeleteDevice but with a context.
+func (cli *Client) DeleteDeviceWithContext(ctx context.Context, deviceID string, req *ReqDeleteDevice) (resp *RespUserInteractive, err error) {
+	urlPath := cli.BuildURL("devices", deviceID)
+	err = cli.MakeRequestWithContext(ctx, "DELETE", urlPath, req, nil)
+	return userInteractiveResponse(err)
+}
+
+// DeleteDevices deletes several devices of the current user at once, see DeleteDevice for the auth flow.
+func (cli *Client) DeleteDevices(req *ReqDeleteDevices) (resp *RespUserInteractive, err error) {
+	return cli.DeleteDevicesWithContext(context.Background(), req)
+}
+
+// DeleteDevicesWithContext is like DeleteDevices but with a context.
+func (cli *Client) DeleteDevicesWithContext(ctx context.Context, req *ReqDeleteDevices) (resp *RespUserInteractive, err error) {
+	urlPath := cli.BuildURL("delete_devices")
+	err = cli.MakeRequestWithContext(ctx, "POST", urlPath, req, nil)
+	return userInteractiveResponse(err)
+}
+
+// userInteractiveResponse extracts the auth flows from a 401 response to a request requiring
+// user-interactive authentication.
+func userInteractiveResponse(err error) (*RespUserInteractive, error) {
+	var httpErr HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != http.StatusUnauthorized {
+		return nil, err
+	}
+	var resp RespUserInteractive
+	if jsonErr := json.Unmarshal(httpErr.Contents, &resp); jsonErr != nil || len(resp.Flows) == 0 {
+		return nil, err
+	}
+	return &resp, err
+}
+
 func txnID() string {
 	return "go" + strconv.FormatInt(time.Now().UnixNano(), 10)
 }
 
 // GetStateEvent get a state event from a room.
 func (cli *Client) GetStateEvent(roomID, eventType, stateKey string) (resp map[string]interface{}, err error) {
+	return cli.GetStateEventWithContext(context.Background(), roomID, eventType, stateKey)
+}
+
+// GetStateEventWithContext is like GetStateEvent but with a context.
+func (cli *Client) GetStateEventWithContext(ctx context.Context, roomID, eventType, stateKey string) (resp map[string]interface{}, err error) {
 	urlPath := cli.BuildURL("rooms", roomID, "state", eventType, stateKey)
-	err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	err = cli.MakeRequestWithContext(ctx, "GET", urlPath, nil, &resp)
 	return
 }
 
 // SendStateEvent sends a state event into a room.
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
 func (cli *Client) SendStateEvent(roomID, eventType, stateKey string, contentJSON interface{}) (resp *RespSendEvent, err error) {
+	return cli.SendStateEventWithContext(context.Background(), roomID, eventType, stateKey, contentJSON)
+}
+
+// SendStateEventWithContext is like SendStateEvent but with a context.
+func (cli *Client) SendStateEventWithContext(ctx context.Context, roomID, eventType, stateKey string, contentJSON interface{}) (resp *RespSendEvent, err error) {
 	urlPath := cli.BuildURL("rooms", roomID, "state", eventType, stateKey)
-	err = cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+	err = cli.MakeRequestWithContext(ctx, "PUT", urlPath, contentJSON, &resp)
 	return
 }
 
 // SendMessageEvent sends a message event into a room.
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
 func (cli *Client) SendMessageEvent(roomID string, eventType string, contentJSON interface{}) (resp *RespSendEvent, err error) {
+	return cli.SendMessageEventWithContext(context.Background(), roomID, eventType, contentJSON)
+}
+
+// SendMessageEventWithContext is like SendMessageEvent but with a context.
+func (cli *Client) SendMessageEventWithContext(ctx context.Context, roomID string, eventType string, contentJSON interface{}) (resp *RespSendEvent, err error) {
 	txnID := txnID()
 	urlPath := cli.BuildURL("rooms", roomID, "send", eventType, txnID)
-	err = cli.MakeRequest("PUT", urlPath, contentJSON, &resp)
+	err = cli.MakeRequestWithContext(ctx, "PUT", urlPath, contentJSON, &resp)
+	return
+}
+
+// RedactEvent redacts the given event. The transaction ID is generated once, so that retries of the request
+// (e.g. after rate limiting) are deduplicated by the server instead of sending several redactions.
+func (cli *Client) RedactEvent(roomID, eventID, reason string) (resp *RespSendEvent, err error) {
+	return cli.RedactEventWithContext(context.Background(), roomID, eventID, reason)
+}
+
+// RedactEventWithContext is like RedactEvent but with a context.
+func (cli *Client) RedactEventWithContext(ctx context.Context, roomID, eventID, reason string) (resp *RespSendEvent, err error) {
+	txnID := txnID()
+	urlPath := cli.BuildURL("rooms", roomID, "redact", eventID, txnID)
+	err = cli.MakeRequestWithContext(ctx, "PUT", urlPath, &ReqRedact{Reason: reason}, &resp)
+	return
+}
+
+// SendToDevice sends to-device events of the given type. messages maps user IDs to device IDs (or "*" for all
+// devices of the user) to event contents.
+func (cli *Client) SendToDevice(eventType string, messages map[string]map[string]interface{}) (err error) {
+	return cli.SendToDeviceWithContext(context.Background(), eventType, messages)
+}
+
+// SendToDeviceWithContext is like SendToDevice but with a context.
+func (cli *Client) SendToDeviceWithContext(ctx context.Context, eventType string, messages map[string]map[string]interface{}) (err error) {
+	txnID := txnID()
+	urlPath := cli.BuildURL("sendToDevice", eventType, txnID)
+	err = cli.MakeRequestWithContext(ctx, "PUT", urlPath, &ReqSendToDevice{Messages: messages}, nil)
 	return
 }
 
 // SendText sends an m.room.message event into the given room with a msgtype of m.text
 func (cli *Client) SendText(roomID, text string) (*RespSendEvent, error) {
-	return cli.SendMessageEvent(roomID, "m.room.message",
+	return cli.SendTextWithContext(context.Background(), roomID, text)
+}
+
+// SendTextWithContext is like SendText but with a context.
+func (cli *Client) SendTextWithContext(ctx context.Context, roomID, text string) (*RespSendEvent, error) {
+	return cli.SendMessageEventWithContext(ctx, roomID, "m.room.message",
 		TextMessage{MsgType: "m.text", Body: text})
 }
 
 // SendFormattedText sends an m.room.message event into the given room with a msgtype of m.text, supports a subset of HTML for formatting.
 func (cli *Client) SendFormattedText(roomID, text, formattedText string) (*RespSendEvent, error) {
-	return cli.SendMessageEvent(roomID, "m.room.message",
+	return cli.SendFormattedTextWithContext(context.Background(), roomID, text, formattedText)
+}
+
+// SendFormattedTextWithContext is like SendFormattedText but with a context.
+func (cli *Client) SendFormattedTextWithContext(ctx context.Context, roomID, text, formattedText string) (*RespSendEvent, error) {
+	return cli.SendMessageEventWithContext(ctx, roomID, "m.room.message",
 		TextMessage{MsgType: "m.text", Body: text, FormattedBody: formattedText, Format: "org.sdn.custom.html"})
 }
 
 // SendImage sends an m.room.message event into the given room with a msgtype of m.image
 func (cli *Client) SendImage(roomID, body, url string) (*RespSendEvent, error) {
-	return cli.SendMessageEvent(roomID, "m.room.message",
+	return cli.SendImageWithContext(context.Background(), roomID, body, url)
+}
+
+// SendImageWithContext is like SendImage but with a context.
+func (cli *Client) SendImageWithContext(ctx context.Context, roomID, body, url string) (*RespSendEvent, error) {
+	return cli.SendMessageEventWithContext(ctx, roomID, "m.room.message",
 		ImageMessage{
 			MsgType: "m.image",
 			Body:    body,
@@ -235,7 +611,12 @@ func (cli *Client) SendImage(roomID, body, url string) (*RespSendEvent, error) {
 
 // SendVideo sends an m.room.message event into the given room with a msgtype of m.video
 func (cli *Client) SendVideo(roomID, body, url string) (*RespSendEvent, error) {
-	return cli.SendMessageEvent(roomID, "m.room.message",
+	return cli.SendVideoWithContext(context.Background(), roomID, body, url)
+}
+
+// SendVideoWithContext is like SendVideo but with a context.
+func (cli *Client) SendVideoWithContext(ctx context.Context, roomID, body, url string) (*RespSendEvent, error) {
+	return cli.SendMessageEventWithContext(ctx, roomID, "m.room.message",
 		VideoMessage{
 			MsgType: "m.video",
 			Body:    body,
@@ -243,9 +624,60 @@ func (cli *Client) SendVideo(roomID, body, url string) (*RespSendEvent, error) {
 		})
 }
 
+// SendAudio sends an m.room.message event into the given room with a msgtype of m.audio
+func (cli *Client) SendAudio(roomID, body, url string, duration time.Duration) (*RespSendEvent, error) {
+	return cli.SendAudioWithContext(context.Background(), roomID, body, url, duration)
+}
+
+// SendAudioWithContext is like SendAudio but with a context.
+func (cli *Client) SendAudioWithContext(ctx context.Context, roomID, body, url string, duration time.Duration) (*RespSendEvent, error) {
+	return cli.SendMessageEventWithContext(ctx, roomID, "m.room.message",
+		AudioMessage{
+			MsgType: "m.audio",
+			Body:    body,
+			URL:     url,
+			Info:    AudioInfo{Duration: uint(duration.Milliseconds())},
+		})
+}
+
+// SendLocation sends an m.room.message event into the given room with a msgtype of m.location
+func (cli *Client) SendLocation(roomID, body string, latitude, longitude float64) (*RespSendEvent, error) {
+	return cli.SendLocationWithContext(context.Background(), roomID, body, latitude, longitude)
+}
+
+// SendLocationWithContext is like SendLocation but with a context.
+func (cli *Client) SendLocationWithContext(ctx context.Context, roomID, body string, latitude, longitude float64) (*RespSendEvent, error) {
+	return cli.SendMessageEventWithContext(ctx, roomID, "m.room.message",
+		LocationMessage{
+			MsgType: "m.location",
+			Body:    body,
+			GeoURI:  GeoURI(latitude, longitude),
+		})
+}
+
+// SendSticker sends an m.sticker event into the given room
+func (cli *Client) SendSticker(roomID, body, url string, info StickerInfo) (*RespSendEvent, error) {
+	return cli.SendStickerWithContext(context.Background(), roomID, body, url, info)
+}
+
+// SendStickerWithContext is like SendSticker but with a context.
+func (cli *Client) SendStickerWithContext(ctx context.Context, roomID, body, url string, info StickerInfo) (*RespSendEvent, error) {
+	return cli.SendMessageEventWithContext(ctx, roomID, "m.sticker",
+		StickerMessage{
+			Body: body,
+			URL:  url,
+			Info: info,
+		})
+}
+
 // SendNotice sends an m.room.message event into the given room with a msgtype of m.notice
 func (cli *Client) SendNotice(roomID, text string) (*RespSendEvent, error) {
-	return cli.SendMessageEvent(roomID, "m.room.message",
+	return cli.SendNoticeWithContext(context.Background(), roomID, text)
+}
+
+// SendNoticeWithContext is like SendNotice but with a context.
+func (cli *Client) SendNoticeWithContext(ctx context.Context, roomID, text string) (*RespSendEvent, error) {
+	return cli.SendMessageEventWithContext(ctx, roomID, "m.room.message",
 		TextMessage{MsgType: "m.notice", Body: text})
 }
 
@@ -260,31 +692,58 @@ func (cli *Client) SendNotice(roomID, text string) (*RespSendEvent, error) {
 //
 // If you wish to continue retrying in spite of these fatal errors, call Sync() again.
 func (cli *Client) Sync() error {
+	return cli.SyncWithContext(context.Background())
+}
+
+// SyncWithContext is like Sync but with a context. Cancelling the context aborts the in-flight /sync request
+// immediately and makes SyncWithContext return the context's error. StopSync, or starting another Sync, also
+// aborts the in-flight request, in which case nil is returned. Requests made by a Syncer implementing
+// ContextSyncer, such as gap filling in DefaultSyncer, are aborted the same way.
+func (cli *Client) SyncWithContext(ctx context.Context) error {
 	// Mark the client as syncing.
 	// We will keep syncing until the syncing state changes. Either because
 	// Sync is called or StopSync is called.
-	syncingID := cli.incrementSyncingID()
-	nextBatch := cli.Store.LoadNextBatch(cli.UserID)
-	filterID := cli.Store.LoadFilterID(cli.UserID)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	syncingID := cli.incrementSyncingID(cancel)
+	userID := cli.getUserID()
+	nextBatch := cli.Store.LoadNextBatch(userID)
+	filterID := cli.Store.LoadFilterID(userID)
 	if filterID == "" {
-		filterJSON := cli.Syncer.GetFilterJSON(cli.UserID)
-		resFilter, err := cli.CreateFilter(filterJSON)
+		filterJSON := cli.Syncer.GetFilterJSON(userID)
+		resFilter, err := cli.CreateFilterWithContext(ctx, filterJSON)
 		if err != nil {
+			if cli.getSyncingID() != syncingID {
+				return nil
+			}
 			return err
 		}
 		filterID = resFilter.FilterID
-		cli.Store.SaveFilterID(cli.UserID, filterID)
+		cli.Store.SaveFilterID(userID, filterID)
 	}
 
 	for {
 		log.Infof("syncing with %s", nextBatch)
-		resSync, err := cli.SyncRequest(30000, nextBatch, filterID, false, "")
+		resSync, err := cli.SyncRequestWithContext(ctx, 30000, nextBatch, filterID, false, cli.SyncPresence)
 		if err != nil {
+			if cli.getSyncingID() != syncingID {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			duration, err2 := cli.Syncer.OnFailedSync(resSync, err)
 			if err2 != nil {
 				return err2
 			}
-			time.Sleep(duration)
+			select {
+			case <-ctx.Done():
+				if cli.getSyncingID() != syncingID {
+					return nil
+				}
+				return ctx.Err()
+			case <-time.After(duration):
+			}
 			continue
 		}
 
@@ -298,18 +757,31 @@ func (cli *Client) Sync() error {
 		// Save the token now *before* processing it. This means it's possible
 		// to not process some events, but it means that we won't get constantly stuck processing
 		// a malformed/buggy event which keeps making us panic.
-		cli.Store.SaveNextBatch(cli.UserID, resSync.NextBatch)
-		if err = cli.Syncer.ProcessResponse(resSync, nextBatch); err != nil {
+		cli.Store.SaveNextBatch(userID, resSync.NextBatch)
+		if contextSyncer, ok := cli.Syncer.(ContextSyncer); ok {
+			err = contextSyncer.ProcessResponseWithContext(ctx, resSync, nextBatch)
+		} else {
+			err = cli.Syncer.ProcessResponse(resSync, nextBatch)
+		}
+		if err != nil {
 			return err
 		}
+		if cli.getSyncingID() != syncingID {
+			return nil
+		}
 
 		nextBatch = resSync.NextBatch
 	}
 }
 
-func (cli *Client) incrementSyncingID() uint32 {
+// incrementSyncingID marks a new Sync as the active one, aborting the previous one (if any) through its cancel func.
+func (cli *Client) incrementSyncingID(cancel context.CancelFunc) uint32 {
 	cli.syncingMutex.Lock()
 	defer cli.syncingMutex.Unlock()
+	if cli.syncingCancel != nil {
+		cli.syncingCancel()
+	}
+	cli.syncingCancel = cancel
 	cli.syncingID++
 	return cli.syncingID
 }
@@ -323,11 +795,16 @@ func (cli *Client) getSyncingID() uint32 {
 // StopSync stops the ongoing sync started by Sync.
 func (cli *Client) StopSync() {
 	// Advance the syncing state so that any running Syncs will terminate.
-	cli.incrementSyncingID()
+	cli.incrementSyncingID(nil)
 }
 
 // SyncRequest makes an sync request
 func (cli *Client) SyncRequest(timeout int, since, filterID string, fullState bool, setPresence string) (resp *RespSync, err error) {
+	return cli.SyncRequestWithContext(context.Background(), timeout, since, filterID, fullState, setPresence)
+}
+
+// SyncRequestWithContext is like SyncRequest but with a context.
+func (cli *Client) SyncRequestWithContext(ctx context.Context, timeout int, since, filterID string, fullState bool, setPresence string) (resp *RespSync, err error) {
 	query := map[string]string{
 		"timeout": strconv.Itoa(timeout),
 	}
@@ -344,27 +821,42 @@ func (cli *Client) SyncRequest(timeout int, since, filterID string, fullState bo
 		query["full_state"] = "true"
 	}
 	urlPath := cli.BuildURLWithQuery([]string{"sync"}, query)
-	err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	err = cli.MakeRequestWithContext(ctx, "GET", urlPath, nil, &resp)
 	return
 }
 
 // CreateFilter .
 func (cli *Client) CreateFilter(filter json.RawMessage) (resp *RespCreateFilter, err error) {
-	urlPath := cli.BuildURL("user", cli.UserID, "filter")
-	err = cli.MakeRequest("POST", urlPath, &filter, &resp)
+	return cli.CreateFilterWithContext(context.Background(), filter)
+}
+
+// CreateFilterWithContext is like CreateFilter but with a context.
+func (cli *Client) CreateFilterWithContext(ctx context.Context, filter json.RawMessage) (resp *RespCreateFilter, err error) {
+	urlPath := cli.BuildURL("user", cli.getUserID(), "filter")
+	err = cli.MakeRequestWithContext(ctx, "POST", urlPath, &filter, &resp)
 	return
 }
 
 // PutRoomInSquad .
 func (cli *Client) PutRoomInSquad(squadID, roomID string, reqBody json.RawMessage) (resp *RespSendEvent, err error) {
+	return cli.PutRoomInSquadWithContext(context.Background(), squadID, roomID, reqBody)
+}
+
+// PutRoomInSquadWithContext is like PutRoomInSquad but with a context.
+func (cli *Client) PutRoomInSquadWithContext(ctx context.Context, squadID, roomID string, reqBody json.RawMessage) (resp *RespSendEvent, err error) {
 	urlPath := cli.BuildURL("oauth", "rooms", squadID, "state", "m.space.child", roomID)
-	err = cli.MakeRequest("PUT", urlPath, &reqBody, &resp)
+	err = cli.MakeRequestWithContext(ctx, "PUT", urlPath, &reqBody, &resp)
 	return
 }
 
 // GetRoomsInSquad .
 func (cli *Client) GetRoomsInSquad(squadID string) (resp []ChildRoomInfo, err error) {
+	return cli.GetRoomsInSquadWithContext(context.Background(), squadID)
+}
+
+// GetRoomsInSquadWithContext is like GetRoomsInSquad but with a context.
+func (cli *Client) GetRoomsInSquadWithContext(ctx context.Context, squadID string) (resp []ChildRoomInfo, err error) {
 	urlPath := cli.BuildURL("oauth", "rooms_in_squad", squadID)
-	err = cli.MakeRequest("GET", urlPath, nil, &resp)
+	err = cli.MakeRequestWithContext(ctx, "GET", urlPath, nil, &resp)
 	return
 }
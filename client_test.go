@@ -0,0 +1,128 @@
+package sdnclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ethereumcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+// reply writes v as the JSON response of a test server.
+func reply(t *testing.T, w http.ResponseWriter, v interface{}) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Error(err)
+	}
+}
+
+// handleTestLogin adds to mux the endpoints of the DID login of any wallet with the DID did:test, which issues
+// the token new-token for the device NEWDEVICE.
+func handleTestLogin(t *testing.T, mux *http.ServeMux) {
+	mux.HandleFunc("/_api/client/v3/address/", func(w http.ResponseWriter, r *http.Request) {
+		reply(t, w, DIDListResponse{Data: []string{"did:test"}})
+	})
+	mux.HandleFunc("/_api/client/v3/did/pre_login1", func(w http.ResponseWriter, r *http.Request) {
+		reply(t, w, PreLoginResponse{DID: "did:test", Message: "sign me"})
+	})
+	mux.HandleFunc("/_api/client/v3/did/login", func(w http.ResponseWriter, r *http.Request) {
+		reply(t, w, DIDLoginResponse{AccessToken: "new-token", UserId: "@bot:test", DeviceId: "NEWDEVICE"})
+	})
+}
+
+// newTestClient returns a client of server logged in with the token expired-token on the device OLDDEVICE.
+func newTestClient(t *testing.T, server *httptest.Server) *Client {
+	t.Helper()
+	key, err := ethereumcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewClientWithSigner(&Config{
+		Endpoint:    server.URL,
+		UserID:      "@bot:test",
+		AccessToken: "expired-token",
+		DeviceID:    "OLDDEVICE",
+	}, NewPrivateKeySigner(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+// rejectExpiredToken replies M_UNKNOWN_TOKEN and returns true unless the request uses new-token.
+func rejectExpiredToken(t *testing.T, w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Authorization") == "Bearer new-token" {
+		return false
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	reply(t, w, RespError{ErrCode: "M_UNKNOWN_TOKEN", Err: "unknown token"})
+	return true
+}
+
+func TestRelogin(t *testing.T) {
+	mux := http.NewServeMux()
+	handleTestLogin(t, mux)
+	mux.HandleFunc("/_api/client/r0/joined_rooms", func(w http.ResponseWriter, r *http.Request) {
+		if !rejectExpiredToken(t, w, r) {
+			reply(t, w, RespJoinedRooms{JoinedRooms: []string{"!room:test"}})
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	cli := newTestClient(t, server)
+	var refreshed *LoginResult
+	cli.OnTokenRefreshed = func(res *LoginResult) { refreshed = res }
+
+	resp, err := cli.GetJoinedRooms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.JoinedRooms) != 1 {
+		t.Errorf("got joined rooms %v, want one room", resp.JoinedRooms)
+	}
+	if _, accessToken := cli.Credentials(); accessToken != "new-token" {
+		t.Errorf("got access token %q, want new-token", accessToken)
+	}
+	if cli.DeviceID != "NEWDEVICE" || cli.DID != "did:test" {
+		t.Errorf("got device %q and DID %q, want NEWDEVICE and did:test", cli.DeviceID, cli.DID)
+	}
+	if refreshed == nil || refreshed.AccessToken != "new-token" || refreshed.DeviceID != "NEWDEVICE" || refreshed.DID != "did:test" {
+		t.Errorf("OnTokenRefreshed got %+v", refreshed)
+	}
+}
+
+func TestNewClientWalletAddress(t *testing.T) {
+	key, err := ethereumcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := NewPrivateKeySigner(key)
+	other, err := ethereumcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		walletAddress string
+		wantErr       bool
+	}{
+		{"unset", "", false},
+		{"same", signer.Address(), false},
+		{"lower case", strings.ToLower(signer.Address()), false},
+		{"other key", ethereumcrypto.PubkeyToAddress(other.PublicKey).Hex(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The credentials are set, so that no login is attempted.
+			config := &Config{WalletAddress: tt.walletAddress, UserID: "@bot:test", AccessToken: "token"}
+			_, err := NewClientWithSigner(config, signer)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && !strings.EqualFold(config.WalletAddress, signer.Address()) {
+				t.Errorf("got wallet address %s, want %s", config.WalletAddress, signer.Address())
+			}
+		})
+	}
+}
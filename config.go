@@ -0,0 +1,119 @@
+package sdnclient
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfig reads a configuration from a YAML file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// SaveConfig writes a configuration to a YAML file, e.g. to persist the access token after login.
+//
+// The file is replaced atomically and is never readable by group or others: a new file gets mode 0600 and an
+// existing file keeps its permissions minus any group/other bits.
+func SaveConfig(path string, config *Config) error {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm() & 0700
+	}
+	return writeFileAtomic(path, data, mode)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it over path, so that path always
+// holds either the old or the new contents.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath) // no-op after a successful rename
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	// Make the rename itself durable. Not all platforms support syncing a directory, so errors are ignored.
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		_ = dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// String implements fmt.Stringer without revealing the private key or access token.
+func (c Config) String() string {
+	redact := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return "<redacted>"
+	}
+	return fmt.Sprintf("{Endpoint:%s WalletAddress:%s PrivateKey:%s KeystorePath:%s RemoteSigner:%s DID:%s UserID:%s AccessToken:%s DeviceID:%s}",
+		c.Endpoint, c.WalletAddress, redact(c.PrivateKey), c.KeystorePath, c.RemoteSigner, c.DID, c.UserID, redact(c.AccessToken), c.DeviceID)
+}
+
+// keystorePassphrase returns the passphrase of the keystore, read from KeystorePassphraseEnv,
+// KeystorePassphraseFile or, if neither is set, prompted for on the terminal.
+func (c *Config) keystorePassphrase() (string, error) {
+	switch {
+	case c.KeystorePassphraseEnv != "":
+		passphrase, ok := os.LookupEnv(c.KeystorePassphraseEnv)
+		if !ok {
+			return "", fmt.Errorf("keystore passphrase environment variable %s is not set", c.KeystorePassphraseEnv)
+		}
+		return passphrase, nil
+	case c.KeystorePassphraseFile != "":
+		data, err := os.ReadFile(c.KeystorePassphraseFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	default:
+		fd := int(os.Stdin.Fd())
+		if !term.IsTerminal(fd) {
+			return "", errors.New("no keystore passphrase source configured and stdin is not a terminal")
+		}
+		fmt.Fprintf(os.Stderr, "Passphrase for %s: ", c.KeystorePath)
+		passphrase, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		return string(passphrase), nil
+	}
+}
@@ -0,0 +1,93 @@
+package sdnclient
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Sentinel errors for the common SDN error codes. They match any RespError with the same errcode when used
+// with errors.Is, including RespErrors wrapped in an HTTPError:
+//
+//	if _, err := cli.JoinRoom(roomID); errors.Is(err, sdnclient.ErrForbidden) {
+//		...
+//	}
+var (
+	ErrForbidden        = RespError{ErrCode: "M_FORBIDDEN"}
+	ErrUnknownToken     = RespError{ErrCode: "M_UNKNOWN_TOKEN"}
+	ErrMissingToken     = RespError{ErrCode: "M_MISSING_TOKEN"}
+	ErrBadJSON          = RespError{ErrCode: "M_BAD_JSON"}
+	ErrNotJSON          = RespError{ErrCode: "M_NOT_JSON"}
+	ErrNotFound         = RespError{ErrCode: "M_NOT_FOUND"}
+	ErrLimitExceeded    = RespError{ErrCode: "M_LIMIT_EXCEEDED"}
+	ErrUnknown          = RespError{ErrCode: "M_UNKNOWN"}
+	ErrUnrecognized     = RespError{ErrCode: "M_UNRECOGNIZED"}
+	ErrUnauthorized     = RespError{ErrCode: "M_UNAUTHORIZED"}
+	ErrUserInUse        = RespError{ErrCode: "M_USER_IN_USE"}
+	ErrRoomInUse        = RespError{ErrCode: "M_ROOM_IN_USE"}
+	ErrInvalidParam     = RespError{ErrCode: "M_INVALID_PARAM"}
+	ErrMissingParam     = RespError{ErrCode: "M_MISSING_PARAM"}
+	ErrTooLarge         = RespError{ErrCode: "M_TOO_LARGE"}
+	ErrGuestAccess      = RespError{ErrCode: "M_GUEST_ACCESS_FORBIDDEN"}
+	ErrIncompatibleRoom = RespError{ErrCode: "M_INCOMPATIBLE_ROOM_VERSION"}
+)
+
+// Is reports whether target is a RespError with the same errcode, so that errors.Is can be used with the
+// sentinel errors.
+func (e RespError) Is(target error) bool {
+	switch t := target.(type) {
+	case RespError:
+		return t.ErrCode == e.ErrCode
+	case *RespError:
+		return t != nil && t.ErrCode == e.ErrCode
+	}
+	return false
+}
+
+// IsForbidden returns true if err is an M_FORBIDDEN error.
+func IsForbidden(err error) bool {
+	return errors.Is(err, ErrForbidden)
+}
+
+// IsUnknownToken returns true if err is an M_UNKNOWN_TOKEN error, i.e. the access token is no longer valid.
+func IsUnknownToken(err error) bool {
+	return errors.Is(err, ErrUnknownToken)
+}
+
+// IsMissingToken returns true if err is an M_MISSING_TOKEN error.
+func IsMissingToken(err error) bool {
+	return errors.Is(err, ErrMissingToken)
+}
+
+// IsNotFound returns true if err is an M_NOT_FOUND error.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// IsLimitExceeded returns true if err is an M_LIMIT_EXCEEDED error or an HTTP 429 response.
+func IsLimitExceeded(err error) bool {
+	if errors.Is(err, ErrLimitExceeded) {
+		return true
+	}
+	var httpErr HTTPError
+	return errors.As(err, &httpErr) && httpErr.Code == http.StatusTooManyRequests
+}
+
+// IsRoomInUse returns true if err is an M_ROOM_IN_USE error, e.g. when creating a room with a taken alias.
+func IsRoomInUse(err error) bool {
+	return errors.Is(err, ErrRoomInUse)
+}
+
+// IsUserInUse returns true if err is an M_USER_IN_USE error.
+func IsUserInUse(err error) bool {
+	return errors.Is(err, ErrUserInUse)
+}
+
+// IsInvalidParam returns true if err is an M_INVALID_PARAM error.
+func IsInvalidParam(err error) bool {
+	return errors.Is(err, ErrInvalidParam)
+}
+
+// IsTooLarge returns true if err is an M_TOO_LARGE error.
+func IsTooLarge(err error) bool {
+	return errors.Is(err, ErrTooLarge)
+}
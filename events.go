@@ -1,5 +1,13 @@
 package sdnclient
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 // Event represents a single SDN event
 type Event struct {
 	StateKey    *string                `json:"state_key,omitempty"`    // The state key for the event. Only present on State Events.
@@ -14,6 +22,104 @@ type Event struct {
 	PrevContent map[string]interface{} `json:"prev_content,omitempty"` // The JSON prev_content of the event.
 }
 
+// copy returns a deep copy of the event, or nil if event is nil.
+func (event *Event) copy() *Event {
+	if event == nil {
+		return nil
+	}
+	c := *event
+	if event.StateKey != nil {
+		stateKey := *event.StateKey
+		c.StateKey = &stateKey
+	}
+	c.Unsigned = copyJSONMap(event.Unsigned)
+	c.Content = copyJSONMap(event.Content)
+	c.PrevContent = copyJSONMap(event.PrevContent)
+	return &c
+}
+
+// copyJSONMap returns a deep copy of a map decoded from JSON.
+func copyJSONMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = copyJSONValue(v)
+	}
+	return c
+}
+
+func copyJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return copyJSONMap(v)
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = copyJSONValue(e)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// RedactedEventID returns the ID of the event redacted by an m.room.redaction event, from the top-level
+// redacts key or, in newer room versions, from the content.
+func (event *Event) RedactedEventID() string {
+	if event.Redacts != "" {
+		return event.Redacts
+	}
+	redacts, _ := event.Content["redacts"].(string)
+	return redacts
+}
+
+// ThreadID returns the ID of the thread root of an event sent in a thread, from its m.thread relation, or ""
+// for events of the main timeline.
+func (event *Event) ThreadID() string {
+	relatesTo, _ := event.Content["m.relates_to"].(map[string]interface{})
+	if relType, _ := relatesTo["rel_type"].(string); relType != "m.thread" {
+		return ""
+	}
+	threadID, _ := relatesTo["event_id"].(string)
+	return threadID
+}
+
+// redactionKeepKeys lists, by event type, the content keys preserved by the redaction algorithm.
+var redactionKeepKeys = map[string][]string{
+	"m.room.member":             {"membership"},
+	"m.room.create":             {"creator"},
+	"m.room.join_rules":         {"join_rule"},
+	"m.room.power_levels":       {"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default"},
+	"m.room.history_visibility": {"history_visibility"},
+	"m.room.aliases":            {"aliases"},
+}
+
+// redact strips the event as the server does when it is redacted by the given m.room.redaction event.
+func (event *Event) redact(redaction *Event) {
+	content := make(map[string]interface{})
+	for _, key := range redactionKeepKeys[event.Type] {
+		if value, ok := event.Content[key]; ok {
+			content[key] = value
+		}
+	}
+	event.Content = content
+	event.PrevContent = nil
+	event.Unsigned = map[string]interface{}{"redacted_because": redaction.copy()}
+}
+
+// SenderDevice returns the device which sent a to-device event, as found in the content fields used by the
+// common to-device event types, or "" if the event doesn't tell.
+func (event *Event) SenderDevice() string {
+	for _, key := range []string{"sender_device", "device_id", "requesting_device_id", "from_device"} {
+		if deviceID, ok := event.Content[key].(string); ok && deviceID != "" {
+			return deviceID
+		}
+	}
+	return ""
+}
+
 // Body returns the value of the "body" key in the event content if it is
 // present and is a string.
 func (event *Event) Body() (body string, ok bool) {
@@ -60,6 +166,138 @@ type ImageMessage struct {
 	Info    ImageInfo `json:"info"`
 }
 
+// FileMessage is an m.file event
+type FileMessage struct {
+	MsgType string   `json:"msgtype"`
+	Body    string   `json:"body"`
+	URL     string   `json:"url"`
+	Info    FileInfo `json:"info"`
+}
+
+// FileInfo contains info about a file
+type FileInfo struct {
+	Mimetype      string        `json:"mimetype,omitempty"`
+	Size          uint          `json:"size,omitempty"`
+	ThumbnailInfo ThumbnailInfo `json:"thumbnail_info,omitempty"`
+	ThumbnailURL  string        `json:"thumbnail_url,omitempty"`
+}
+
+// AudioMessage is an m.audio event
+type AudioMessage struct {
+	MsgType string    `json:"msgtype"`
+	Body    string    `json:"body"`
+	URL     string    `json:"url"`
+	Info    AudioInfo `json:"info"`
+}
+
+// AudioInfo contains info about an audio clip
+type AudioInfo struct {
+	Mimetype string `json:"mimetype,omitempty"`
+	Duration uint   `json:"duration,omitempty"` // The duration in milliseconds
+	Size     uint   `json:"size,omitempty"`
+}
+
+// LocationMessage is an m.location event
+type LocationMessage struct {
+	MsgType string       `json:"msgtype"`
+	Body    string       `json:"body"`
+	GeoURI  string       `json:"geo_uri"`
+	Info    LocationInfo `json:"info"`
+}
+
+// LocationInfo contains info about a location
+type LocationInfo struct {
+	ThumbnailInfo ThumbnailInfo `json:"thumbnail_info,omitempty"`
+	ThumbnailURL  string        `json:"thumbnail_url,omitempty"`
+}
+
+// StickerMessage is the content of an m.sticker event. Unlike the other messages, stickers are sent as their
+// own event type instead of an m.room.message with a msgtype.
+type StickerMessage struct {
+	Body string      `json:"body"`
+	URL  string      `json:"url"`
+	Info StickerInfo `json:"info"`
+}
+
+// StickerInfo contains info about a sticker image
+type StickerInfo struct {
+	Height        uint          `json:"h,omitempty"`
+	Width         uint          `json:"w,omitempty"`
+	Mimetype      string        `json:"mimetype,omitempty"`
+	Size          uint          `json:"size,omitempty"`
+	ThumbnailInfo ThumbnailInfo `json:"thumbnail_info,omitempty"`
+	ThumbnailURL  string        `json:"thumbnail_url,omitempty"`
+}
+
+// GeoURI returns the RFC 5870 geo URI of the given coordinates, as used by LocationMessage.
+func GeoURI(latitude, longitude float64) string {
+	return "geo:" + strconv.FormatFloat(latitude, 'f', -1, 64) + "," + strconv.FormatFloat(longitude, 'f', -1, 64)
+}
+
+// ParseGeoURI returns the coordinates of an RFC 5870 geo URI. The altitude and parameters are ignored.
+func ParseGeoURI(geoURI string) (latitude, longitude float64, err error) {
+	if !strings.HasPrefix(geoURI, "geo:") {
+		return 0, 0, fmt.Errorf("invalid geo URI %q", geoURI)
+	}
+	coords, _, _ := strings.Cut(strings.TrimPrefix(geoURI, "geo:"), ";")
+	parts := strings.Split(coords, ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, 0, fmt.Errorf("invalid geo URI %q", geoURI)
+	}
+	if latitude, err = strconv.ParseFloat(parts[0], 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid geo URI %q: %w", geoURI, err)
+	}
+	if longitude, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid geo URI %q: %w", geoURI, err)
+	}
+	return latitude, longitude, nil
+}
+
+// ErrNotMessage is returned by Event.ParseMessage for events which are neither m.room.message nor m.sticker.
+var ErrNotMessage = errors.New("event is not a message")
+
+// ParseMessage parses the content of an m.room.message or m.sticker event into the struct matching its
+// msgtype: *TextMessage (m.text, m.notice, m.emote and unknown msgtypes, whose body is still meant to be
+// displayed), *ImageMessage, *VideoMessage, *AudioMessage, *FileMessage, *LocationMessage or *StickerMessage.
+//
+//	switch msg := msg.(type) {
+//	case *sdnclient.ImageMessage:
+//		...
+//	}
+func (event *Event) ParseMessage() (interface{}, error) {
+	var msg interface{}
+	switch event.Type {
+	case "m.sticker":
+		msg = &StickerMessage{}
+	case "m.room.message":
+		msgtype, _ := event.MessageType()
+		switch msgtype {
+		case "m.image":
+			msg = &ImageMessage{}
+		case "m.video":
+			msg = &VideoMessage{}
+		case "m.audio":
+			msg = &AudioMessage{}
+		case "m.file":
+			msg = &FileMessage{}
+		case "m.location":
+			msg = &LocationMessage{}
+		default:
+			msg = &TextMessage{}
+		}
+	default:
+		return nil, ErrNotMessage
+	}
+	data, err := json.Marshal(event.Content)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
 // ImageInfo contains info about an image
 type ImageInfo struct {
 	Height        uint          `json:"h,omitempty"`
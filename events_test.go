@@ -0,0 +1,165 @@
+package sdnclient
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEventRedact(t *testing.T) {
+	redaction := &Event{Type: "m.room.redaction", ID: "$redaction", Redacts: "$event"}
+	tests := []struct {
+		name      string
+		eventType string
+		content   map[string]interface{}
+		want      map[string]interface{}
+	}{
+		{"message", "m.room.message",
+			map[string]interface{}{"msgtype": "m.text", "body": "secret"},
+			map[string]interface{}{}},
+		{"member", "m.room.member",
+			map[string]interface{}{"membership": "join", "displayname": "Alice", "avatar_url": "mxc://test/a"},
+			map[string]interface{}{"membership": "join"}},
+		{"join rules", "m.room.join_rules",
+			map[string]interface{}{"join_rule": "invite", "allow": []interface{}{}},
+			map[string]interface{}{"join_rule": "invite"}},
+		{"power levels", "m.room.power_levels",
+			map[string]interface{}{"ban": 50.0, "users": map[string]interface{}{"@a:test": 100.0}, "notifications": map[string]interface{}{"room": 50.0}},
+			map[string]interface{}{"ban": 50.0, "users": map[string]interface{}{"@a:test": 100.0}}},
+		{"missing kept key", "m.room.history_visibility",
+			map[string]interface{}{"other": "x"},
+			map[string]interface{}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := &Event{
+				Type:        tt.eventType,
+				ID:          "$event",
+				Content:     tt.content,
+				PrevContent: map[string]interface{}{"body": "old"},
+				Unsigned:    map[string]interface{}{"age": 1.0},
+			}
+			event.redact(redaction)
+			if !reflect.DeepEqual(event.Content, tt.want) {
+				t.Errorf("content = %v, want %v", event.Content, tt.want)
+			}
+			if event.PrevContent != nil {
+				t.Errorf("prev_content = %v, want nil", event.PrevContent)
+			}
+			because, _ := event.Unsigned["redacted_because"].(*Event)
+			if len(event.Unsigned) != 1 || because == nil || because.ID != redaction.ID {
+				t.Errorf("unsigned = %v, want only redacted_because", event.Unsigned)
+			}
+		})
+	}
+}
+
+func TestRoomRedact(t *testing.T) {
+	stateKey := "@alice:test"
+	room := NewRoom("!room:test")
+	room.UpdateState(&Event{Type: "m.room.member", StateKey: &stateKey, ID: "$member",
+		Content: map[string]interface{}{"membership": "join", "displayname": "Alice"}})
+
+	if original := room.Redact(&Event{Type: "m.room.redaction", Redacts: "$unknown"}); original != nil {
+		t.Errorf("redacting an unknown event returned %v", original)
+	}
+	// Newer room versions put redacts in the content.
+	original := room.Redact(&Event{Type: "m.room.redaction", Content: map[string]interface{}{"redacts": "$member"}})
+	if original == nil || original.Content["displayname"] != "Alice" {
+		t.Fatalf("got original %v, want the event before the redaction", original)
+	}
+	event := room.GetStateEvent("m.room.member", stateKey)
+	if !reflect.DeepEqual(event.Content, map[string]interface{}{"membership": "join"}) {
+		t.Errorf("got content %v after the redaction", event.Content)
+	}
+}
+
+func TestParseGeoURI(t *testing.T) {
+	tests := []struct {
+		uri       string
+		latitude  float64
+		longitude float64
+		wantErr   bool
+	}{
+		{"geo:51.5,-0.12", 51.5, -0.12, false},
+		{"geo:-33.8688,151.2093", -33.8688, 151.2093, false},
+		{"geo:51.5,-0.12,35", 51.5, -0.12, false},
+		{"geo:51.5,-0.12;u=20", 51.5, -0.12, false},
+		{"geo:51.5,-0.12,35;crs=wgs84;u=20", 51.5, -0.12, false},
+		{"51.5,-0.12", 0, 0, true},
+		{"geo:51.5", 0, 0, true},
+		{"geo:1,2,3,4", 0, 0, true},
+		{"geo:north,-0.12", 0, 0, true},
+		{"geo:51.5,", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uri, func(t *testing.T) {
+			latitude, longitude, err := ParseGeoURI(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseGeoURI() error = %v, want error %t", err, tt.wantErr)
+			}
+			if latitude != tt.latitude || longitude != tt.longitude {
+				t.Errorf("ParseGeoURI() = %g, %g, want %g, %g", latitude, longitude, tt.latitude, tt.longitude)
+			}
+		})
+	}
+	if uri := GeoURI(51.5, -0.12); uri != "geo:51.5,-0.12" {
+		t.Errorf("GeoURI() = %q", uri)
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		eventType string
+		content   map[string]interface{}
+		want      interface{}
+	}{
+		{"text", "m.room.message",
+			map[string]interface{}{"msgtype": "m.text", "body": "hi"},
+			&TextMessage{MsgType: "m.text", Body: "hi"}},
+		{"notice", "m.room.message",
+			map[string]interface{}{"msgtype": "m.notice", "body": "hi"},
+			&TextMessage{MsgType: "m.notice", Body: "hi"}},
+		{"unknown msgtype", "m.room.message",
+			map[string]interface{}{"msgtype": "org.example.poll", "body": "fallback"},
+			&TextMessage{MsgType: "org.example.poll", Body: "fallback"}},
+		{"image", "m.room.message",
+			map[string]interface{}{"msgtype": "m.image", "body": "cat.png", "url": "mxc://test/cat",
+				"info": map[string]interface{}{"w": 800.0, "h": 600.0, "mimetype": "image/png"}},
+			&ImageMessage{MsgType: "m.image", Body: "cat.png", URL: "mxc://test/cat",
+				Info: ImageInfo{Width: 800, Height: 600, Mimetype: "image/png"}}},
+		{"video", "m.room.message",
+			map[string]interface{}{"msgtype": "m.video", "body": "clip", "url": "mxc://test/clip", "info": map[string]interface{}{"duration": 2000.0}},
+			&VideoMessage{MsgType: "m.video", Body: "clip", URL: "mxc://test/clip", Info: VideoInfo{Duration: 2000}}},
+		{"audio", "m.room.message",
+			map[string]interface{}{"msgtype": "m.audio", "body": "voice", "url": "mxc://test/voice", "info": map[string]interface{}{"duration": 1500.0, "size": 42.0}},
+			&AudioMessage{MsgType: "m.audio", Body: "voice", URL: "mxc://test/voice", Info: AudioInfo{Duration: 1500, Size: 42}}},
+		{"file", "m.room.message",
+			map[string]interface{}{"msgtype": "m.file", "body": "a.pdf", "url": "mxc://test/a", "info": map[string]interface{}{"mimetype": "application/pdf"}},
+			&FileMessage{MsgType: "m.file", Body: "a.pdf", URL: "mxc://test/a", Info: FileInfo{Mimetype: "application/pdf"}}},
+		{"location", "m.room.message",
+			map[string]interface{}{"msgtype": "m.location", "body": "London", "geo_uri": "geo:51.5,-0.12"},
+			&LocationMessage{MsgType: "m.location", Body: "London", GeoURI: "geo:51.5,-0.12"}},
+		{"sticker", "m.sticker",
+			map[string]interface{}{"body": "wave", "url": "mxc://test/wave", "info": map[string]interface{}{"w": 128.0, "h": 128.0}},
+			&StickerMessage{Body: "wave", URL: "mxc://test/wave", Info: StickerInfo{Width: 128, Height: 128}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := (&Event{Type: tt.eventType, Content: tt.content}).ParseMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseMessage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := (&Event{Type: "m.room.member"}).ParseMessage(); err != ErrNotMessage {
+		t.Errorf("ParseMessage() of a member event: got error %v, want ErrNotMessage", err)
+	}
+	if _, err := (&Event{Type: "m.room.message", Content: map[string]interface{}{"msgtype": "m.image", "info": "bad"}}).ParseMessage(); err == nil {
+		t.Error("ParseMessage() of a malformed image: got no error")
+	}
+}
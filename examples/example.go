@@ -5,32 +5,30 @@ import (
 	"fmt"
 	sdnclient "github.com/sending-network/sendingnetwork-bot"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v3"
 	"os"
 	"strings"
 )
 
 func main() {
 
-	configData, err := os.ReadFile("config.yaml")
+	config, err := sdnclient.LoadConfig("config.yaml")
 	if err != nil {
 		log.Fatal(err)
 	}
-	config := sdnclient.Config{}
-	if err := yaml.Unmarshal(configData, &config); err != nil {
-		log.Fatalf("error: %v", err)
-	}
 
-	cli, err := sdnclient.NewClient(&config)
+	cli, err := sdnclient.NewClient(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	outConfig, err := yaml.Marshal(config)
-	if err != nil {
-		log.Fatal(err)
+	saveConfig(config)
+	cli.OnTokenRefreshed = func(res *sdnclient.LoginResult) {
+		config.UserID = res.UserID
+		config.AccessToken = res.AccessToken
+		config.DID = res.DID
+		config.DeviceID = res.DeviceID
+		saveConfig(config)
 	}
-	_ = os.WriteFile("config.yaml", outConfig, 0644)
 
 	syncer := cli.Syncer.(*sdnclient.DefaultSyncer)
 	syncer.OnEventType("m.room.message", func(ev *sdnclient.Event) {
@@ -52,6 +50,12 @@ func main() {
 	}
 }
 
+func saveConfig(config *sdnclient.Config) {
+	if err := sdnclient.SaveConfig("config.yaml", config); err != nil {
+		log.Errorf("failed to save config: %v", err)
+	}
+}
+
 func processCommand(client *sdnclient.Client, command string) {
 	parts := strings.Split(command, " ")
 	if len(parts) < 2 || parts[0] != "room" {
@@ -108,6 +112,32 @@ func processCommand(client *sdnclient.Client, command string) {
 		} else {
 			fmt.Println("kick success")
 		}
+	case "ban":
+		roomId := parts[2]
+		userId := parts[3]
+		_, err := client.BanUser(roomId, &sdnclient.ReqBanUser{UserID: userId})
+		if err != nil {
+			fmt.Printf("err: %v\n", err)
+		} else {
+			fmt.Println("ban success")
+		}
+	case "unban":
+		roomId := parts[2]
+		userId := parts[3]
+		_, err := client.UnbanUser(roomId, &sdnclient.ReqUnbanUser{UserID: userId})
+		if err != nil {
+			fmt.Printf("err: %v\n", err)
+		} else {
+			fmt.Println("unban success")
+		}
+	case "forget":
+		roomId := parts[2]
+		_, err := client.ForgetRoom(roomId)
+		if err != nil {
+			fmt.Printf("err: %v\n", err)
+		} else {
+			fmt.Println("forget success")
+		}
 	case "members":
 		roomId := parts[2]
 		resp, err := client.JoinedMembers(roomId)
@@ -0,0 +1,210 @@
+package sdnclient
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FileStore implements the Storer interface.
+//
+// Everything is kept in memory and written through to a directory, so that syncing resumes where it stopped
+// after a restart. Filter IDs, next batch tokens and account data are stored in store.json, each room in its
+// own file under rooms/. Every file is replaced atomically, so a crash leaves either the old or the new contents.
+//
+// Presence is only kept in memory, since it is stale after a restart anyway.
+//
+// The Storer interface can't return errors, so write errors are logged.
+type FileStore struct {
+	path        string
+	mutex       sync.Mutex // protects the maps and serializes writes
+	filters     map[string]string
+	nextBatch   map[string]string
+	rooms       map[string]*Room
+	accountData map[string]map[string]*Event
+	presences   map[string]*Presence
+}
+
+// fileStoreData is the content of store.json.
+type fileStoreData struct {
+	Filters     map[string]string            `json:"filters"`
+	NextBatch   map[string]string            `json:"next_batch"`
+	AccountData map[string]map[string]*Event `json:"account_data,omitempty"`
+}
+
+// NewFileStore constructs a new FileStore in the directory path, loading what was saved there before.
+// The directory is created if needed.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path:        path,
+		filters:     make(map[string]string),
+		nextBatch:   make(map[string]string),
+		rooms:       make(map[string]*Room),
+		accountData: make(map[string]map[string]*Event),
+		presences:   make(map[string]*Presence),
+	}
+	if err := os.MkdirAll(s.roomsPath(), 0700); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(s.dataPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var stored fileStoreData
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, err
+		}
+		for k, v := range stored.Filters {
+			s.filters[k] = v
+		}
+		for k, v := range stored.NextBatch {
+			s.nextBatch[k] = v
+		}
+		for k, v := range stored.AccountData {
+			s.accountData[k] = v
+		}
+	}
+
+	entries, err := os.ReadDir(s.roomsPath())
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.roomsPath(), entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		room := NewRoom("")
+		if err := json.Unmarshal(data, room); err != nil {
+			return nil, err
+		}
+		if room.ID != "" {
+			s.rooms[room.ID] = room
+		}
+	}
+	return s, nil
+}
+
+func (s *FileStore) dataPath() string {
+	return filepath.Join(s.path, "store.json")
+}
+
+func (s *FileStore) roomsPath() string {
+	return filepath.Join(s.path, "rooms")
+}
+
+func (s *FileStore) roomPath(roomID string) string {
+	return filepath.Join(s.roomsPath(), url.QueryEscape(roomID)+".json")
+}
+
+// saveData writes store.json. The caller must hold the mutex.
+func (s *FileStore) saveData() {
+	data, err := json.Marshal(fileStoreData{Filters: s.filters, NextBatch: s.nextBatch, AccountData: s.accountData})
+	if err == nil {
+		err = writeFileAtomic(s.dataPath(), data, 0600)
+	}
+	if err != nil {
+		log.Errorf("failed to save %s: %v", s.dataPath(), err)
+	}
+}
+
+// SaveFilterID to disk.
+func (s *FileStore) SaveFilterID(userID, filterID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.filters[userID] = filterID
+	s.saveData()
+}
+
+// LoadFilterID from disk.
+func (s *FileStore) LoadFilterID(userID string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.filters[userID]
+}
+
+// SaveNextBatch to disk.
+func (s *FileStore) SaveNextBatch(userID, nextBatchToken string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextBatch[userID] = nextBatchToken
+	s.saveData()
+}
+
+// LoadNextBatch from disk.
+func (s *FileStore) LoadNextBatch(userID string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.nextBatch[userID]
+}
+
+// SaveRoom to disk.
+func (s *FileStore) SaveRoom(room *Room) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rooms[room.ID] = room
+	data, err := json.Marshal(room)
+	if err == nil {
+		err = writeFileAtomic(s.roomPath(room.ID), data, 0600)
+	}
+	if err != nil {
+		log.Errorf("failed to save room %s: %v", room.ID, err)
+	}
+}
+
+// LoadRoom from disk.
+func (s *FileStore) LoadRoom(roomID string) *Room {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rooms[roomID]
+}
+
+// SaveAccountData to disk.
+func (s *FileStore) SaveAccountData(roomID string, event *Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.accountData[roomID] == nil {
+		s.accountData[roomID] = make(map[string]*Event)
+	}
+	s.accountData[roomID][event.Type] = event.copy()
+	s.saveData()
+}
+
+// LoadAccountData from disk.
+func (s *FileStore) LoadAccountData(roomID, eventType string) *Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.accountData[roomID][eventType].copy()
+}
+
+// SavePresence to memory.
+func (s *FileStore) SavePresence(presence *Presence) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.presences[presence.UserID] = copyPresence(presence)
+}
+
+// LoadPresence from memory.
+func (s *FileStore) LoadPresence(userID string) *Presence {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return copyPresence(s.presences[userID])
+}
+
+// LoadPresences from memory.
+func (s *FileStore) LoadPresences() map[string]*Presence {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return copyPresences(s.presences)
+}
@@ -2,10 +2,17 @@ package sdnclient
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // HTTPError An HTTP Error response, which may wrap an underlying native Go Error.
@@ -14,6 +21,7 @@ type HTTPError struct {
 	WrappedError error
 	Message      string
 	Code         int
+	RetryAfter   time.Duration // How long the server asked us to wait before retrying. Only set for rate-limited requests.
 }
 
 func (e HTTPError) Error() string {
@@ -21,21 +29,143 @@ func (e HTTPError) Error() string {
 	if e.WrappedError != nil {
 		wrappedErrMsg = e.WrappedError.Error()
 	}
-	return fmt.Sprintf("contents=%v msg=%s code=%d wrapped=%s", e.Contents, e.Message, e.Code, wrappedErrMsg)
+	return fmt.Sprintf("contents=%s msg=%s code=%d wrapped=%s", e.Contents, e.Message, e.Code, wrappedErrMsg)
+}
+
+// Unwrap returns the wrapped error, usually a RespError, so that errors.Is and errors.As can inspect it.
+func (e HTTPError) Unwrap() error {
+	return e.WrappedError
+}
+
+// RetryPolicy controls how MakeRequest retries requests which were rejected because of rate limiting
+// (HTTP 429 or M_LIMIT_EXCEEDED).
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one. Values below 2 disable retries.
+	MaxAttempts int
+	// MaxWait is the longest time to wait before a single retry. If the server asks us to wait longer,
+	// the error is returned instead. Zero means no limit.
+	MaxWait time.Duration
+	// Methods lists the HTTP methods which may be retried. If empty, all methods are retried.
+	Methods []string
+}
+
+// NewDefaultRetryPolicy returns the RetryPolicy used by NewClient: up to 5 attempts of any method,
+// waiting at most 30 seconds between them.
+func NewDefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: 5,
+		MaxWait:     30 * time.Second,
+	}
+}
+
+// retryDelay returns how long to wait before the next attempt of a request, or false if it must not be retried.
+// attempt is the number of attempts made so far.
+func (p *RetryPolicy) retryDelay(method string, attempt int, err error) (time.Duration, bool) {
+	if p == nil || attempt >= p.MaxAttempts {
+		return 0, false
+	}
+	var httpErr HTTPError
+	if !errors.As(err, &httpErr) || !IsLimitExceeded(httpErr) {
+		return 0, false
+	}
+	if len(p.Methods) > 0 {
+		allowed := false
+		for _, m := range p.Methods {
+			if strings.EqualFold(m, method) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return 0, false
+		}
+	}
+	wait := httpErr.RetryAfter
+	if wait <= 0 {
+		// The server didn't tell us how long to wait, back off exponentially from one second.
+		wait = time.Second << (attempt - 1)
+		if p.MaxWait > 0 && wait > p.MaxWait {
+			wait = p.MaxWait
+		}
+	}
+	if p.MaxWait > 0 && wait > p.MaxWait {
+		return 0, false
+	}
+	return wait, true
+}
+
+// parseRetryAfter returns the wait time requested by a rate-limited response, preferring retry_after_ms
+// from the error body over the Retry-After header.
+func parseRetryAfter(respErr RespError, header string) time.Duration {
+	if respErr.RetryAfterMs > 0 {
+		return time.Duration(respErr.RetryAfterMs) * time.Millisecond
+	}
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Until(t)
+	}
+	return 0
 }
 
 // MakeRequest makes a JSON HTTP request to the given URL
 func (cli *Client) MakeRequest(method string, httpURL string, reqBody interface{}, resBody interface{}) error {
-	var req *http.Request
-	var err error
+	return cli.MakeRequestWithContext(context.Background(), method, httpURL, reqBody, resBody)
+}
+
+// MakeRequestWithContext is like MakeRequest but with a context. The request is aborted when the context is done.
+//
+// Rate-limited requests are retried according to Client.RetryPolicy. If the retries are exhausted, the returned
+// HTTPError has RetryAfter set. If the access token is rejected and Client.AutoRelogin is set, the client logs
+// in again and replays the request once.
+func (cli *Client) MakeRequestWithContext(ctx context.Context, method string, httpURL string, reqBody interface{}, resBody interface{}) error {
+	var body []byte
 	if reqBody != nil {
 		buf := new(bytes.Buffer)
 		if err := json.NewEncoder(buf).Encode(reqBody); err != nil {
 			return err
 		}
-		req, err = http.NewRequest(method, httpURL, buf)
+		body = buf.Bytes()
+	}
+
+	relogged := false
+	for attempt := 1; ; attempt++ {
+		accessToken := cli.getAccessToken()
+		err := cli.doRequest(ctx, method, httpURL, accessToken, body, resBody)
+		if !relogged && cli.AutoRelogin && cli.Signer != nil && IsUnknownToken(err) {
+			relogged = true
+			if loginErr := cli.relogin(ctx, accessToken); loginErr != nil {
+				log.Errorf("re-login failed: %v", loginErr)
+				return err
+			}
+			attempt--
+			continue
+		}
+		wait, retry := cli.RetryPolicy.retryDelay(method, attempt, err)
+		if !retry {
+			return err
+		}
+		log.Debugf("rate limited on %s %s, retrying in %s", method, httpURL, wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// doRequest makes a single attempt of a JSON HTTP request. body is the encoded request body, or nil.
+func (cli *Client) doRequest(ctx context.Context, method string, httpURL string, accessToken string, body []byte, resBody interface{}) error {
+	var req *http.Request
+	var err error
+	if body != nil {
+		req, err = http.NewRequestWithContext(ctx, method, httpURL, bytes.NewReader(body))
 	} else {
-		req, err = http.NewRequest(method, httpURL, nil)
+		req, err = http.NewRequestWithContext(ctx, method, httpURL, nil)
 	}
 
 	if err != nil {
@@ -44,8 +174,8 @@ func (cli *Client) MakeRequest(method string, httpURL string, reqBody interface{
 
 	req.Header.Set("Content-Type", "application/json")
 
-	if cli.AccessToken != "" {
-		req.Header.Set("Authorization", "Bearer "+cli.AccessToken)
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
 	}
 
 	res, err := cli.httpClient.Do(req)
@@ -56,35 +186,125 @@ func (cli *Client) MakeRequest(method string, httpURL string, reqBody interface{
 		return err
 	}
 	if res.StatusCode != http.StatusOK { // not 2xx
-		contents, err := io.ReadAll(res.Body)
-		if err != nil {
-			return err
-		}
+		return responseError(res, method, "JSON")
+	}
 
-		var wrap error
-		var respErr RespError
-		if _ = json.Unmarshal(contents, &respErr); respErr.ErrCode != "" {
-			wrap = respErr
-		}
+	if resBody != nil && res.Body != nil {
+		return json.NewDecoder(res.Body).Decode(&resBody)
+	}
+
+	return nil
+}
+
+// responseError builds the HTTPError for a failed response. what names the kind of request in the message.
+func responseError(res *http.Response, method string, what string) error {
+	contents, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	var wrap error
+	var respErr RespError
+	if _ = json.Unmarshal(contents, &respErr); respErr.ErrCode != "" {
+		wrap = respErr
+	}
+
+	// If we failed to decode as RespError, don't just drop the HTTP body, include it in the
+	// HTTP error instead (e.g proxy errors which return HTML).
+	msg := "Failed to " + method + " " + what + " to " + res.Request.URL.Path
+	if wrap == nil {
+		msg = msg + ": " + string(contents)
+	}
+
+	httpErr := HTTPError{
+		Contents:     contents,
+		Code:         res.StatusCode,
+		Message:      msg,
+		WrappedError: wrap,
+	}
+	if IsLimitExceeded(httpErr) {
+		httpErr.RetryAfter = parseRetryAfter(respErr, res.Header.Get("Retry-After"))
+	}
+	return httpErr
+}
 
-		// If we failed to decode as RespError, don't just drop the HTTP body, include it in the
-		// HTTP error instead (e.g proxy errors which return HTML).
-		msg := "Failed to " + method + " JSON to " + req.URL.Path
-		if wrap == nil {
-			msg = msg + ": " + string(contents)
+// makeMediaRequest makes a request to the media repository and returns the response, whose body the caller
+// must close. body is streamed as is and isn't closed. Like MakeRequestWithContext, rate-limited requests are
+// retried and requests are replayed once after an automatic re-login, as long as there is no body or the body
+// is an io.Seeker which can be rewound.
+func (cli *Client) makeMediaRequest(ctx context.Context, method string, httpURL string, body io.Reader, contentType string, contentLength int64) (*http.Response, error) {
+	replayable := body == nil
+	seeker, _ := body.(io.Seeker)
+	var start int64
+	if seeker != nil {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err == nil {
+			replayable = true
 		}
+	}
 
-		return HTTPError{
-			Contents:     contents,
-			Code:         res.StatusCode,
-			Message:      msg,
-			WrappedError: wrap,
+	relogged := false
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && seeker != nil {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		accessToken := cli.getAccessToken()
+		res, err := cli.doMediaRequest(ctx, method, httpURL, accessToken, body, contentType, contentLength)
+		if err == nil || !replayable {
+			return res, err
+		}
+		if !relogged && cli.AutoRelogin && cli.Signer != nil && IsUnknownToken(err) {
+			relogged = true
+			if loginErr := cli.relogin(ctx, accessToken); loginErr != nil {
+				log.Errorf("re-login failed: %v", loginErr)
+				return nil, err
+			}
+			attempt--
+			continue
+		}
+		wait, retry := cli.RetryPolicy.retryDelay(method, attempt, err)
+		if !retry {
+			return nil, err
+		}
+		log.Debugf("rate limited on %s %s, retrying in %s", method, httpURL, wait)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
 		}
 	}
+}
 
-	if resBody != nil && res.Body != nil {
-		return json.NewDecoder(res.Body).Decode(&resBody)
+// doMediaRequest makes a single attempt of a request to the media repository.
+func (cli *Client) doMediaRequest(ctx context.Context, method string, httpURL string, accessToken string, body io.Reader, contentType string, contentLength int64) (*http.Response, error) {
+	var reqBody io.Reader
+	if body != nil {
+		// The HTTP client closes the request body, which belongs to the caller.
+		reqBody = io.NopCloser(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, httpURL, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if body != nil && contentLength >= 0 {
+		req.ContentLength = contentLength
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
 	}
 
-	return nil
+	res, err := cli.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, responseError(res, method, "media")
+	}
+	return res, nil
 }
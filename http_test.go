@@ -0,0 +1,109 @@
+package sdnclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	limited := HTTPError{Code: http.StatusTooManyRequests, WrappedError: ErrLimitExceeded}
+	limitedAfter := func(d time.Duration) error {
+		err := limited
+		err.RetryAfter = d
+		return err
+	}
+	policy := &RetryPolicy{MaxAttempts: 5, MaxWait: 10 * time.Second}
+	getOnly := &RetryPolicy{MaxAttempts: 5, MaxWait: 10 * time.Second, Methods: []string{"GET"}}
+
+	tests := []struct {
+		name      string
+		policy    *RetryPolicy
+		method    string
+		attempt   int
+		err       error
+		wantWait  time.Duration
+		wantRetry bool
+	}{
+		{"nil policy", nil, "GET", 1, limited, 0, false},
+		{"no error", policy, "GET", 1, nil, 0, false},
+		{"other error", policy, "GET", 1, HTTPError{Code: http.StatusForbidden, WrappedError: ErrForbidden}, 0, false},
+		{"network error", policy, "GET", 1, errors.New("connection reset"), 0, false},
+		{"429 without errcode", policy, "GET", 1, HTTPError{Code: http.StatusTooManyRequests}, time.Second, true},
+		{"wrapped", policy, "GET", 1, fmt.Errorf("sync: %w", limited), time.Second, true},
+		{"server wait", policy, "GET", 1, limitedAfter(2 * time.Second), 2 * time.Second, true},
+		{"server wait above max", policy, "GET", 1, limitedAfter(time.Minute), 0, false},
+		{"backoff second attempt", policy, "GET", 2, limited, 2 * time.Second, true},
+		{"backoff third attempt", policy, "GET", 3, limited, 4 * time.Second, true},
+		{"backoff fourth attempt", policy, "GET", 4, limited, 8 * time.Second, true},
+		{"backoff capped at max wait", &RetryPolicy{MaxAttempts: 10, MaxWait: 10 * time.Second}, "GET", 6, limited, 10 * time.Second, true},
+		{"attempts exhausted", policy, "GET", 5, limited, 0, false},
+		{"retries disabled", &RetryPolicy{MaxAttempts: 1}, "GET", 1, limited, 0, false},
+		{"no max wait", &RetryPolicy{MaxAttempts: 5}, "GET", 1, limitedAfter(time.Hour), time.Hour, true},
+		{"allowed method", getOnly, "get", 1, limited, time.Second, true},
+		{"disallowed method", getOnly, "POST", 1, limited, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wait, retry := tt.policy.retryDelay(tt.method, tt.attempt, tt.err)
+			if wait != tt.wantWait || retry != tt.wantRetry {
+				t.Errorf("retryDelay() = %s, %t, want %s, %t", wait, retry, tt.wantWait, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestUploadMediaReplay(t *testing.T) {
+	const content = "file content"
+	tests := []struct {
+		name      string
+		body      func() io.Reader
+		wantErr   bool
+		wantTries int
+	}{
+		{"seekable", func() io.Reader { return strings.NewReader(content) }, false, 3},
+		{"not seekable", func() io.Reader { return io.MultiReader(strings.NewReader(content)) }, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tries int
+			mux := http.NewServeMux()
+			handleTestLogin(t, mux)
+			mux.HandleFunc("/_api/media/r0/upload", func(w http.ResponseWriter, r *http.Request) {
+				tries++
+				if body, err := io.ReadAll(r.Body); err != nil || string(body) != content {
+					t.Errorf("got body %q, %v, want %q", body, err, content)
+				}
+				// Rate limit the first attempt, then reject the expired token.
+				if tries == 1 {
+					w.WriteHeader(http.StatusTooManyRequests)
+					reply(t, w, RespError{ErrCode: "M_LIMIT_EXCEEDED", Err: "too many requests", RetryAfterMs: 1})
+					return
+				}
+				if !rejectExpiredToken(t, w, r) {
+					reply(t, w, RespMediaUpload{ContentURI: "mxc://test/media"})
+				}
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+			cli := newTestClient(t, server)
+
+			resp, err := cli.UploadMedia(tt.body(), "text/plain", int64(len(content)))
+			if tt.wantErr {
+				if err == nil {
+					t.Error("the upload succeeded")
+				}
+			} else if err != nil || resp.ContentURI != "mxc://test/media" {
+				t.Errorf("UploadMedia() = %+v, %v", resp, err)
+			}
+			if tries != tt.wantTries {
+				t.Errorf("got %d attempts, want %d", tries, tt.wantTries)
+			}
+		})
+	}
+}
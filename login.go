@@ -9,9 +9,7 @@ import (
 	"io"
 	"net/http"
 
-	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/common/hexutil"
-	ethereumcrypto "github.com/ethereum/go-ethereum/crypto"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -54,7 +52,7 @@ type DIDLoginResponse struct {
 }
 
 func GetDIDList(ctx context.Context, hostname, address string) ([]string, error) {
-	resByte, err := sendRequest("GET",
+	resByte, err := sendRequest(ctx, "GET",
 		fmt.Sprintf("%v/_api/client/v3/address/%v", hostname, address), "", nil)
 	if err != nil {
 		log.Errorf("room-state-test-case GetDIDList fail. err:%v", err.Error())
@@ -77,7 +75,7 @@ func CreateDID(ctx context.Context, hostname, address string) (*CreateDIDRespons
 		Address: address,
 	}
 	body, _ := json.Marshal(req)
-	resByte, err := sendRequest("POST", fmt.Sprintf("%v/_api/client/v3/did/create", hostname), "", body)
+	resByte, err := sendRequest(ctx, "POST", fmt.Sprintf("%v/_api/client/v3/did/create", hostname), "", body)
 	if err != nil {
 		log.Errorf("room-state-test-case CreateDID fail. err:%v", err.Error())
 		return nil, err
@@ -105,7 +103,7 @@ func SaveDID(ctx context.Context, hostname, did, signature, operation, address,
 		Updated:   updated,
 	}
 	body, _ := json.Marshal(req)
-	_, err := sendRequest("POST", fmt.Sprintf("%v/_api/client/v3/did/%v", hostname, did), "", body)
+	_, err := sendRequest(ctx, "POST", fmt.Sprintf("%v/_api/client/v3/did/%v", hostname, did), "", body)
 	if err != nil {
 		log.Errorf("room-state-test-case SaveDID fail. err:%v", err.Error())
 		return err
@@ -122,7 +120,7 @@ func PreLogin(ctx context.Context, hostname, address, did string) (*PreLoginResp
 		req["address"] = address
 	}
 	body, _ := json.Marshal(req)
-	resByte, err := sendRequest("POST", fmt.Sprintf("%v/_api/client/v3/did/pre_login1", hostname), "", body)
+	resByte, err := sendRequest(ctx, "POST", fmt.Sprintf("%v/_api/client/v3/did/pre_login1", hostname), "", body)
 	if err != nil {
 		log.Errorf("room-state-test-case PreLogin fail. err:%v", err.Error())
 		return nil, err
@@ -152,7 +150,7 @@ func DIDLogin(ctx context.Context, hostname, address string, preLoginResp *PreLo
 		DeviceId: deviceId,
 	}
 	body, _ := json.Marshal(req)
-	resByte, err := sendRequest("POST", fmt.Sprintf("%v/_api/client/v3/did/login", hostname), "", body)
+	resByte, err := sendRequest(ctx, "POST", fmt.Sprintf("%v/_api/client/v3/did/login", hostname), "", body)
 	if err != nil {
 		log.Errorf("room-state-test-case DIDLogin fail. err:%v", err.Error())
 		return nil, err
@@ -169,36 +167,145 @@ func DIDLogin(ctx context.Context, hostname, address string, preLoginResp *PreLo
 
 // Login client login
 func Login(endpoint, address string, privateKey *ecdsa.PrivateKey) (accessToken, userID string, err error) {
-	ctx := context.Background()
-	didList, err := GetDIDList(ctx, endpoint, address)
+	return LoginWithContext(context.Background(), endpoint, address, privateKey)
+}
+
+// LoginWithContext is like Login but with a context.
+func LoginWithContext(ctx context.Context, endpoint, address string, privateKey *ecdsa.PrivateKey) (accessToken, userID string, err error) {
+	return loginWithAddress(ctx, endpoint, address, NewPrivateKeySigner(privateKey))
+}
+
+// LoginWithSigner logs in the wallet of signer, which signs the login message instead of a raw private key.
+func LoginWithSigner(ctx context.Context, endpoint string, signer Signer) (accessToken, userID string, err error) {
+	return loginWithAddress(ctx, endpoint, signer.Address(), signer)
+}
+
+// LoginPath tells how LoginWithOptions chose the DID it logged in with.
+type LoginPath string
+
+const (
+	// LoginPathExistingDID means the wallet logged in with a DID already registered for its address.
+	LoginPathExistingDID LoginPath = "existing_did"
+	// LoginPathCreatedDID means a new DID was created and saved for the wallet before logging in.
+	LoginPathCreatedDID LoginPath = "created_did"
+	// LoginPathAddress means the wallet had no DID and logged in with its address, leaving it to the server.
+	LoginPathAddress LoginPath = "address"
+)
+
+// LoginOptions controls which DID LoginWithOptions logs in with.
+type LoginOptions struct {
+	// DID selects one of the DIDs registered for the wallet address. If empty, the first one is used.
+	DID string
+	// CreateDID creates and saves a DID for the wallet if it has none, instead of logging in with the address.
+	CreateDID bool
+	// DeviceID reuses an existing device. If empty, the server creates a new device.
+	DeviceID string
+}
+
+// LoginResult is the outcome of LoginWithOptions.
+type LoginResult struct {
+	AccessToken string
+	UserID      string
+	DeviceID    string
+	DID         string    // The DID used to log in, empty for LoginPathAddress.
+	Path        LoginPath // How the DID was chosen.
+}
+
+// LoginWithOptions logs in the wallet of signer like LoginWithSigner, choosing or registering the DID according
+// to opts, which may be nil.
+func LoginWithOptions(ctx context.Context, endpoint string, signer Signer, opts *LoginOptions) (*LoginResult, error) {
+	return loginWithOptions(ctx, endpoint, signer.Address(), signer, opts)
+}
+
+func loginWithAddress(ctx context.Context, endpoint, address string, signer Signer) (accessToken, userID string, err error) {
+	res, err := loginWithOptions(ctx, endpoint, address, signer, nil)
 	if err != nil {
 		return "", "", err
 	}
+	return res.AccessToken, res.UserID, nil
+}
 
-	did := ""
-	if len(didList) > 0 {
-		did = didList[0]
+func loginWithOptions(ctx context.Context, endpoint, address string, signer Signer, opts *LoginOptions) (*LoginResult, error) {
+	if opts == nil {
+		opts = &LoginOptions{}
 	}
-	preLoginResponse, err := PreLogin(ctx, endpoint, address, did)
+	didList, err := GetDIDList(ctx, endpoint, address)
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+
+	res := &LoginResult{Path: LoginPathAddress}
+	switch {
+	case opts.DID != "":
+		found := false
+		for _, did := range didList {
+			if did == opts.DID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("DID %s is not registered for address %s", opts.DID, address)
+		}
+		res.DID = opts.DID
+		res.Path = LoginPathExistingDID
+	case len(didList) > 0:
+		res.DID = didList[0]
+		res.Path = LoginPathExistingDID
+	case opts.CreateDID:
+		did, err := registerDID(ctx, endpoint, address, signer)
+		if err != nil {
+			return nil, err
+		}
+		res.DID = did
+		res.Path = LoginPathCreatedDID
 	}
 
-	signature, _ := ethereumcrypto.Sign(accounts.TextHash([]byte(preLoginResponse.Message)), privateKey)
-	didLoginResponse, err := DIDLogin(ctx, endpoint, address, preLoginResponse, hexutil.Encode(signature), "")
+	preLoginResponse, err := PreLogin(ctx, endpoint, address, res.DID)
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+
+	signature, err := signer.SignMessage(ctx, []byte(preLoginResponse.Message))
+	if err != nil {
+		return nil, err
 	}
+	didLoginResponse, err := DIDLogin(ctx, endpoint, address, preLoginResponse, hexutil.Encode(signature), opts.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	res.AccessToken = didLoginResponse.AccessToken
+	res.UserID = didLoginResponse.UserId
+	res.DeviceID = didLoginResponse.DeviceId
+	// For LoginPathAddress the server may still report a DID, but it isn't registered for the address and
+	// passing it back as LoginOptions.DID would fail, so it is not returned.
+	return res, nil
+}
 
-	return didLoginResponse.AccessToken, didLoginResponse.UserId, nil
+// registerDID creates a DID for address and saves it with the signature of the creation message.
+func registerDID(ctx context.Context, endpoint, address string, signer Signer) (string, error) {
+	createResponse, err := CreateDID(ctx, endpoint, address)
+	if err != nil {
+		return "", err
+	}
+	signature, err := signer.SignMessage(ctx, []byte(createResponse.Message))
+	if err != nil {
+		return "", err
+	}
+	err = SaveDID(ctx, endpoint, createResponse.DID, hexutil.Encode(signature), "create", address, createResponse.Updated)
+	if err != nil {
+		return "", err
+	}
+	return createResponse.DID, nil
 }
 
-func sendRequest(method, url, accessToken string, content []byte) ([]byte, error) {
+func sendRequest(ctx context.Context, method, url, accessToken string, content []byte) ([]byte, error) {
 	var body io.Reader
 	if content != nil {
 		body = bytes.NewBuffer(content)
 	}
-	request, err := http.NewRequest(method, url, body)
+	request, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		return nil, err
 	}
@@ -211,12 +318,22 @@ func sendRequest(method, url, accessToken string, content []byte) ([]byte, error
 		return nil, err
 	}
 	defer resp.Body.Close()
-	if err != nil {
-		return nil, err
-	}
 	res, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		var wrap error
+		var respErr RespError
+		if _ = json.Unmarshal(res, &respErr); respErr.ErrCode != "" {
+			wrap = respErr
+		}
+		return nil, HTTPError{
+			Contents:     res,
+			Code:         resp.StatusCode,
+			Message:      "Failed to " + method + " JSON to " + request.URL.Path,
+			WrappedError: wrap,
+		}
+	}
 	return res, nil
 }
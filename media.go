@@ -0,0 +1,354 @@
+package sdnclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif" // register the GIF decoder for image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The bounding box of the thumbnails generated by SendImageFile, and the size of the largest image it decodes
+// to generate one. Decoding needs about 4 bytes per pixel, so larger images are sent without a thumbnail.
+const (
+	maxThumbnailWidth  = 800
+	maxThumbnailHeight = 600
+	maxThumbnailSource = 50 * 1000 * 1000 // pixels
+)
+
+// ParseMXC splits a content URI of the form mxc://<server name>/<media ID>, as returned by UploadMedia.
+func ParseMXC(mxcURL string) (serverName, mediaID string, err error) {
+	u, err := url.Parse(mxcURL)
+	if err != nil {
+		return "", "", err
+	}
+	mediaID = strings.TrimPrefix(u.Path, "/")
+	if u.Scheme != "mxc" || u.Host == "" || mediaID == "" || strings.Contains(mediaID, "/") {
+		return "", "", fmt.Errorf("invalid content URI %q", mxcURL)
+	}
+	return u.Host, mediaID, nil
+}
+
+// buildMediaURL builds a URL to the media repository with query parameters.
+func (cli *Client) buildMediaURL(urlPath []string, urlQuery map[string]string) string {
+	u, _ := url.Parse(cli.Endpoint + path.Join(cli.MediaPathPrefix, path.Join(urlPath...)))
+	q := u.Query()
+	for k, v := range urlQuery {
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// UploadMedia uploads content to the media repository. contentLength is the size of content in bytes, or -1
+// if unknown. The returned ContentURI can be used as the URL of image, video and file messages.
+// If content is an io.Seeker, such as an *os.File or a *bytes.Reader, the upload is retried when rate limited
+// and replayed after an automatic re-login.
+func (cli *Client) UploadMedia(content io.Reader, contentType string, contentLength int64) (*RespMediaUpload, error) {
+	return cli.UploadMediaWithContext(context.Background(), content, contentType, contentLength)
+}
+
+// UploadMediaWithContext is like UploadMedia but with a context.
+func (cli *Client) UploadMediaWithContext(ctx context.Context, content io.Reader, contentType string, contentLength int64) (*RespMediaUpload, error) {
+	urlPath := cli.buildMediaURL([]string{"upload"}, nil)
+	res, err := cli.makeMediaRequest(ctx, "POST", urlPath, content, contentType, contentLength)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var resp RespMediaUpload
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DownloadMedia downloads the content at the given content URI. It returns the content, which the caller
+// must close, and its content type.
+func (cli *Client) DownloadMedia(mxcURL string) (io.ReadCloser, string, error) {
+	return cli.DownloadMediaWithContext(context.Background(), mxcURL)
+}
+
+// DownloadMediaWithContext is like DownloadMedia but with a context.
+func (cli *Client) DownloadMediaWithContext(ctx context.Context, mxcURL string) (io.ReadCloser, string, error) {
+	serverName, mediaID, err := ParseMXC(mxcURL)
+	if err != nil {
+		return nil, "", err
+	}
+	urlPath := cli.buildMediaURL([]string{"download", serverName, mediaID}, nil)
+	res, err := cli.makeMediaRequest(ctx, "GET", urlPath, nil, "", 0)
+	if err != nil {
+		return nil, "", err
+	}
+	return res.Body, res.Header.Get("Content-Type"), nil
+}
+
+// Thumbnail downloads a thumbnail of the content at the given content URI, generated by the server. method is
+// "crop" or "scale". It returns the thumbnail, which the caller must close, and its content type.
+func (cli *Client) Thumbnail(mxcURL string, width, height int, method string) (io.ReadCloser, string, error) {
+	return cli.ThumbnailWithContext(context.Background(), mxcURL, width, height, method)
+}
+
+// ThumbnailWithContext is like Thumbnail but with a context.
+func (cli *Client) ThumbnailWithContext(ctx context.Context, mxcURL string, width, height int, method string) (io.ReadCloser, string, error) {
+	serverName, mediaID, err := ParseMXC(mxcURL)
+	if err != nil {
+		return nil, "", err
+	}
+	query := map[string]string{
+		"width":  strconv.Itoa(width),
+		"height": strconv.Itoa(height),
+	}
+	if method != "" {
+		query["method"] = method
+	}
+	urlPath := cli.buildMediaURL([]string{"thumbnail", serverName, mediaID}, query)
+	res, err := cli.makeMediaRequest(ctx, "GET", urlPath, nil, "", 0)
+	if err != nil {
+		return nil, "", err
+	}
+	return res.Body, res.Header.Get("Content-Type"), nil
+}
+
+// mediaFile is a local file opened for upload.
+type mediaFile struct {
+	*os.File
+	name     string
+	size     int64
+	mimetype string
+}
+
+// openMediaFile opens the file at filePath and sniffs its MIME type, falling back to the file extension if
+// the content doesn't tell.
+func openMediaFile(filePath string) (*mediaFile, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return nil, err
+	}
+	mimetype := http.DetectContentType(head[:n])
+	if mimetype == "application/octet-stream" {
+		if byExt := mime.TypeByExtension(filepath.Ext(filePath)); byExt != "" {
+			mimetype = byExt
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &mediaFile{File: f, name: filepath.Base(filePath), size: info.Size(), mimetype: mimetype}, nil
+}
+
+// upload uploads the whole file and returns its content URI.
+func (f *mediaFile) upload(ctx context.Context, cli *Client) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	resp, err := cli.UploadMediaWithContext(ctx, f.File, f.mimetype, f.size)
+	if err != nil {
+		return "", err
+	}
+	return resp.ContentURI, nil
+}
+
+// SendImageFile uploads the image at filePath and sends it as an m.image message into the given room.
+// The MIME type, size and dimensions of the image are filled in, and a thumbnail fitting in 800x600 is
+// generated and uploaded for larger images of up to 50 megapixels. Images the standard image packages can't
+// decode (anything but JPEG, PNG and GIF) are sent without dimensions and thumbnail.
+func (cli *Client) SendImageFile(roomID, filePath string) (*RespSendEvent, error) {
+	return cli.SendImageFileWithContext(context.Background(), roomID, filePath)
+}
+
+// SendImageFileWithContext is like SendImageFile but with a context.
+func (cli *Client) SendImageFileWithContext(ctx context.Context, roomID, filePath string) (*RespSendEvent, error) {
+	f, err := openMediaFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	msg := ImageMessage{
+		MsgType: "m.image",
+		Body:    f.name,
+		Info: ImageInfo{
+			Mimetype: f.mimetype,
+			Size:     uint(f.size),
+		},
+	}
+	config, format, err := image.DecodeConfig(f)
+	if err != nil {
+		log.Debugf("not reading the dimensions of %s: %v", filePath, err)
+	} else {
+		msg.Info.Width = uint(config.Width)
+		msg.Info.Height = uint(config.Height)
+	}
+
+	if msg.URL, err = f.upload(ctx, cli); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case msg.Info.Width == 0 || msg.Info.Height == 0:
+		// Not an image the standard image packages can decode.
+	case msg.Info.Width <= maxThumbnailWidth && msg.Info.Height <= maxThumbnailHeight:
+		// The image is small enough to be its own thumbnail.
+		msg.Info.ThumbnailURL = msg.URL
+		msg.Info.ThumbnailInfo = ThumbnailInfo{
+			Width:    msg.Info.Width,
+			Height:   msg.Info.Height,
+			Mimetype: msg.Info.Mimetype,
+			Size:     msg.Info.Size,
+		}
+	case uint64(msg.Info.Width)*uint64(msg.Info.Height) > maxThumbnailSource:
+		log.Debugf("not generating a thumbnail for %s: %dx%d pixels is too large", filePath, msg.Info.Width, msg.Info.Height)
+	default:
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		img, _, err := image.Decode(f)
+		if err != nil {
+			log.Debugf("not generating a thumbnail for %s: %v", filePath, err)
+			break
+		}
+		thumbnail, info, err := makeThumbnail(img, format)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := cli.UploadMediaWithContext(ctx, bytes.NewReader(thumbnail), info.Mimetype, int64(len(thumbnail)))
+		if err != nil {
+			return nil, err
+		}
+		msg.Info.ThumbnailURL = resp.ContentURI
+		msg.Info.ThumbnailInfo = info
+	}
+	return cli.SendMessageEventWithContext(ctx, roomID, "m.room.message", msg)
+}
+
+// makeThumbnail scales img down to fit in the thumbnail bounding box and encodes it, as PNG if the image was
+// a PNG or GIF to keep transparency and as JPEG otherwise.
+func makeThumbnail(img image.Image, format string) ([]byte, ThumbnailInfo, error) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width*maxThumbnailHeight > height*maxThumbnailWidth {
+		width, height = maxThumbnailWidth, height*maxThumbnailWidth/width
+	} else {
+		width, height = width*maxThumbnailHeight/height, maxThumbnailHeight
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	thumbnail := resizeNearest(img, width, height)
+
+	buf := new(bytes.Buffer)
+	info := ThumbnailInfo{Width: uint(width), Height: uint(height)}
+	var err error
+	if format == "png" || format == "gif" {
+		info.Mimetype = "image/png"
+		err = png.Encode(buf, thumbnail)
+	} else {
+		info.Mimetype = "image/jpeg"
+		err = jpeg.Encode(buf, thumbnail, nil)
+	}
+	if err != nil {
+		return nil, ThumbnailInfo{}, err
+	}
+	info.Size = uint(buf.Len())
+	return buf.Bytes(), info, nil
+}
+
+// resizeNearest scales src to width x height with nearest-neighbour sampling.
+func resizeNearest(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	bounds := src.Bounds()
+	for y := 0; y < height; y++ {
+		sy := bounds.Min.Y + y*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			sx := bounds.Min.X + x*bounds.Dx()/width
+			dst.Set(x, y, src.At(sx, sy))
+		}
+	}
+	return dst
+}
+
+// SendVideoFile uploads the video at filePath and sends it as an m.video message into the given room.
+// The MIME type and size of the video are filled in. Its dimensions and duration are left out, since the
+// standard library can't parse video containers.
+func (cli *Client) SendVideoFile(roomID, filePath string) (*RespSendEvent, error) {
+	return cli.SendVideoFileWithContext(context.Background(), roomID, filePath)
+}
+
+// SendVideoFileWithContext is like SendVideoFile but with a context.
+func (cli *Client) SendVideoFileWithContext(ctx context.Context, roomID, filePath string) (*RespSendEvent, error) {
+	f, err := openMediaFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	msg := VideoMessage{
+		MsgType: "m.video",
+		Body:    f.name,
+		Info: VideoInfo{
+			Mimetype: f.mimetype,
+			Size:     uint(f.size),
+		},
+	}
+	if msg.URL, err = f.upload(ctx, cli); err != nil {
+		return nil, err
+	}
+	return cli.SendMessageEventWithContext(ctx, roomID, "m.room.message", msg)
+}
+
+// SendFile uploads the file at filePath and sends it as an m.file message into the given room, with its
+// MIME type and size filled in.
+func (cli *Client) SendFile(roomID, filePath string) (*RespSendEvent, error) {
+	return cli.SendFileWithContext(context.Background(), roomID, filePath)
+}
+
+// SendFileWithContext is like SendFile but with a context.
+func (cli *Client) SendFileWithContext(ctx context.Context, roomID, filePath string) (*RespSendEvent, error) {
+	f, err := openMediaFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	msg := FileMessage{
+		MsgType: "m.file",
+		Body:    f.name,
+		Info: FileInfo{
+			Mimetype: f.mimetype,
+			Size:     uint(f.size),
+		},
+	}
+	if msg.URL, err = f.upload(ctx, cli); err != nil {
+		return nil, err
+	}
+	return cli.SendMessageEventWithContext(ctx, roomID, "m.room.message", msg)
+}
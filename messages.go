@@ -0,0 +1,119 @@
+package sdnclient
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// Messages returns a page of room events, starting at the from token and going in the direction dir:
+// 'b' for backwards or 'f' for forwards. to, limit and filter are optional: pass "", 0 and nil to omit them.
+// The end token of the response continues from where the page stopped.
+func (cli *Client) Messages(roomID, from, to string, dir rune, limit int, filter json.RawMessage) (resp *RespMessages, err error) {
+	return cli.MessagesWithContext(context.Background(), roomID, from, to, dir, limit, filter)
+}
+
+// MessagesWithContext is like Messages but with a context.
+func (cli *Client) MessagesWithContext(ctx context.Context, roomID, from, to string, dir rune, limit int, filter json.RawMessage) (resp *RespMessages, err error) {
+	query := map[string]string{
+		"dir": string(dir),
+	}
+	if from != "" {
+		query["from"] = from
+	}
+	if to != "" {
+		query["to"] = to
+	}
+	if limit != 0 {
+		query["limit"] = strconv.Itoa(limit)
+	}
+	if len(filter) != 0 {
+		query["filter"] = string(filter)
+	}
+	urlPath := cli.BuildURLWithQuery([]string{"rooms", roomID, "messages"}, query)
+	err = cli.MakeRequestWithContext(ctx, "GET", urlPath, nil, &resp)
+	return
+}
+
+// MessageIterator walks through the history of a room page by page, using Client.Messages.
+//
+// To read the history before a sync response, start backwards from the prev_batch token of the room timeline.
+type MessageIterator struct {
+	Limit  int             // Number of events per page. If zero, the server default is used.
+	Filter json.RawMessage // Optional RoomEventFilter applied to every page.
+
+	cli     *Client
+	roomID  string
+	dir     rune
+	token   string
+	done    bool
+	pending []Event // events of the last page which Walk stopped before
+}
+
+// NewMessageIterator returns an iterator over the events of a room, starting at the from token and going in
+// the direction dir: 'b' for backwards or 'f' for forwards.
+func (cli *Client) NewMessageIterator(roomID, from string, dir rune) *MessageIterator {
+	return &MessageIterator{
+		cli:    cli,
+		roomID: roomID,
+		dir:    dir,
+		token:  from,
+	}
+}
+
+// Token returns the pagination token the next page fetched from the server will start from. Events left over
+// by a stopped Walk come before it.
+func (it *MessageIterator) Token() string {
+	return it.token
+}
+
+// NextPage returns the next page of events, in the direction of the iterator. It returns io.EOF once the
+// start or end of the room history has been reached. If Walk stopped in the middle of a page, the rest of that
+// page is returned first.
+func (it *MessageIterator) NextPage(ctx context.Context) ([]Event, error) {
+	if len(it.pending) > 0 {
+		events := it.pending
+		it.pending = nil
+		return events, nil
+	}
+	if it.done {
+		return nil, io.EOF
+	}
+	resp, err := it.cli.MessagesWithContext(ctx, it.roomID, it.token, "", it.dir, it.Limit, it.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Chunk) == 0 || resp.End == "" || resp.End == it.token {
+		it.done = true
+	}
+	it.token = resp.End
+	if len(resp.Chunk) == 0 {
+		return nil, io.EOF
+	}
+	for i := range resp.Chunk {
+		resp.Chunk[i].RoomID = it.roomID
+	}
+	return resp.Chunk, nil
+}
+
+// Walk calls fn for every event, fetching pages as needed, until fn returns false or the start or end of the
+// room history has been reached. After fn returns false, the next NextPage or Walk continues with the event
+// after the one fn stopped at.
+func (it *MessageIterator) Walk(ctx context.Context, fn func(*Event) bool) error {
+	for {
+		events, err := it.NextPage(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i := range events {
+			if !fn(&events[i]) {
+				it.pending = events[i+1:]
+				return nil
+			}
+		}
+	}
+}
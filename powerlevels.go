@@ -0,0 +1,209 @@
+package sdnclient
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PowerLevels is the content of an m.room.power_levels event.
+type PowerLevels struct {
+	Users         map[string]int `json:"users,omitempty"`
+	UsersDefault  int            `json:"users_default"`
+	Events        map[string]int `json:"events,omitempty"`
+	EventsDefault int            `json:"events_default"`
+	StateDefault  int            `json:"state_default"`
+	Ban           int            `json:"ban"`
+	Kick          int            `json:"kick"`
+	Redact        int            `json:"redact"`
+	Invite        int            `json:"invite"`
+}
+
+// ParsePowerLevels parses the content of an m.room.power_levels event. Missing fields get their default values.
+// Levels are parsed leniently: older room versions allow them to be strings such as "50", and a value which
+// isn't a number at all is ignored instead of failing the whole event.
+func ParsePowerLevels(event *Event) *PowerLevels {
+	pl := &PowerLevels{
+		StateDefault: 50,
+		Ban:          50,
+		Kick:         50,
+		Redact:       50,
+	}
+	for key, field := range map[string]*int{
+		"users_default":  &pl.UsersDefault,
+		"events_default": &pl.EventsDefault,
+		"state_default":  &pl.StateDefault,
+		"ban":            &pl.Ban,
+		"kick":           &pl.Kick,
+		"redact":         &pl.Redact,
+		"invite":         &pl.Invite,
+	} {
+		if level, ok := parsePowerLevel(event.Content[key]); ok {
+			*field = level
+		}
+	}
+	pl.Users = parsePowerLevelMap(event.Content["users"])
+	pl.Events = parsePowerLevelMap(event.Content["events"])
+	return pl
+}
+
+// parsePowerLevel parses a level decoded from JSON, which is a number or, in older room versions, a string.
+func parsePowerLevel(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case float64:
+		return int(v), true
+	case int:
+		return v, true
+	case string:
+		level, err := strconv.Atoi(strings.TrimSpace(v))
+		return level, err == nil
+	}
+	return 0, false
+}
+
+// parsePowerLevelMap parses a map of levels decoded from JSON, skipping the values which aren't levels.
+func parsePowerLevelMap(value interface{}) map[string]int {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	levels := make(map[string]int, len(m))
+	for k, v := range m {
+		if level, ok := parsePowerLevel(v); ok {
+			levels[k] = level
+		}
+	}
+	return levels
+}
+
+// UserLevel returns the power level of the given user.
+func (pl *PowerLevels) UserLevel(userID string) int {
+	if level, ok := pl.Users[userID]; ok {
+		return level
+	}
+	return pl.UsersDefault
+}
+
+// EventLevel returns the power level required to send an event of the given type.
+func (pl *PowerLevels) EventLevel(eventType string, isState bool) int {
+	if level, ok := pl.Events[eventType]; ok {
+		return level
+	}
+	if isState {
+		return pl.StateDefault
+	}
+	return pl.EventsDefault
+}
+
+// PowerLevels returns the power levels of the room. If the room has no m.room.power_levels event, the room
+// creator has level 100 and everybody else level 0, as the server assumes.
+func (room *Room) PowerLevels() *PowerLevels {
+	if event := room.GetStateEvent("m.room.power_levels", ""); event != nil {
+		return ParsePowerLevels(event)
+	}
+	pl := &PowerLevels{Ban: 50, Kick: 50, Redact: 50}
+	if event := room.GetStateEvent("m.room.create", ""); event != nil {
+		creator, _ := event.Content["creator"].(string)
+		if creator == "" {
+			creator = event.Sender
+		}
+		pl.Users = map[string]int{creator: 100}
+	}
+	return pl
+}
+
+// UserLevel returns the power level of the given user in the room.
+func (room *Room) UserLevel(userID string) int {
+	return room.PowerLevels().UserLevel(userID)
+}
+
+// CanSendEvent returns true if the given user may send an event of the given type to the room.
+func (room *Room) CanSendEvent(userID, eventType string, isState bool) bool {
+	pl := room.PowerLevels()
+	return pl.UserLevel(userID) >= pl.EventLevel(eventType, isState)
+}
+
+// CanKick returns true if the given user may kick targetUserID from the room.
+func (room *Room) CanKick(userID, targetUserID string) bool {
+	pl := room.PowerLevels()
+	level := pl.UserLevel(userID)
+	return level >= pl.Kick && level > pl.UserLevel(targetUserID)
+}
+
+// CanBan returns true if the given user may ban or unban targetUserID in the room.
+func (room *Room) CanBan(userID, targetUserID string) bool {
+	pl := room.PowerLevels()
+	level := pl.UserLevel(userID)
+	return level >= pl.Ban && level > pl.UserLevel(targetUserID)
+}
+
+// CanRedact returns true if the given user may redact events sent by other users in the room.
+// Users can always redact their own events.
+func (room *Room) CanRedact(userID string) bool {
+	pl := room.PowerLevels()
+	return pl.UserLevel(userID) >= pl.Redact
+}
+
+// CanInvite returns true if the given user may invite users to the room.
+func (room *Room) CanInvite(userID string) bool {
+	pl := room.PowerLevels()
+	return pl.UserLevel(userID) >= pl.Invite
+}
+
+// SetUserPowerLevel sets the power level of a user in a room, by reading the current m.room.power_levels
+// state event and sending it back with the user's level changed. Other fields are kept untouched. If the room
+// has no m.room.power_levels event yet, one with the implicit power levels is created: the room creator at
+// level 100 and everybody else allowed to send state events.
+func (cli *Client) SetUserPowerLevel(roomID, userID string, level int) (*RespSendEvent, error) {
+	return cli.SetUserPowerLevelWithContext(context.Background(), roomID, userID, level)
+}
+
+// SetUserPowerLevelWithContext is like SetUserPowerLevel but with a context.
+func (cli *Client) SetUserPowerLevelWithContext(ctx context.Context, roomID, userID string, level int) (*RespSendEvent, error) {
+	content, err := cli.GetStateEventWithContext(ctx, roomID, "m.room.power_levels", "")
+	if IsNotFound(err) {
+		content, err = cli.implicitPowerLevelsWithContext(ctx, roomID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	users, _ := content["users"].(map[string]interface{})
+	if users == nil {
+		users = make(map[string]interface{})
+	}
+	usersDefault, _ := parsePowerLevel(content["users_default"])
+	if level == usersDefault {
+		delete(users, userID)
+	} else {
+		users[userID] = level
+	}
+	content["users"] = users
+	return cli.SendStateEventWithContext(ctx, roomID, "m.room.power_levels", "", content)
+}
+
+// implicitPowerLevelsWithContext returns the content of an m.room.power_levels event with the power levels
+// a room without such an event has: the creator at level 100, everybody else at 0 and a state_default of 0.
+func (cli *Client) implicitPowerLevelsWithContext(ctx context.Context, roomID string) (map[string]interface{}, error) {
+	create, err := cli.GetStateEventWithContext(ctx, roomID, "m.room.create", "")
+	if err != nil {
+		return nil, err
+	}
+	creator, _ := create["creator"].(string)
+	if creator == "" && cli.Store != nil {
+		// Newer room versions only tell the creator as the sender of the event, which the state API doesn't
+		// return, so look it up in the synced room state.
+		if room := cli.Store.LoadRoom(roomID); room != nil {
+			if event := room.GetStateEvent("m.room.create", ""); event != nil {
+				creator = event.Sender
+			}
+		}
+	}
+	if creator == "" {
+		return nil, fmt.Errorf("room %s has no m.room.power_levels event and its creator is unknown", roomID)
+	}
+	return map[string]interface{}{
+		"users":         map[string]interface{}{creator: 100},
+		"state_default": 0,
+	}, nil
+}
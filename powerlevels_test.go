@@ -0,0 +1,136 @@
+package sdnclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// testPowerLevelsRoom returns a room whose m.room.power_levels event has the given content.
+func testPowerLevelsRoom(content map[string]interface{}) *Room {
+	stateKey := ""
+	room := NewRoom("!room:test")
+	room.UpdateState(&Event{Type: "m.room.create", StateKey: &stateKey, Sender: "@creator:test",
+		Content: map[string]interface{}{"creator": "@creator:test"}})
+	if content != nil {
+		room.UpdateState(&Event{Type: "m.room.power_levels", StateKey: &stateKey, Content: content})
+	}
+	return room
+}
+
+func TestCanKickAndBan(t *testing.T) {
+	room := testPowerLevelsRoom(map[string]interface{}{
+		"users": map[string]interface{}{
+			"@admin:test":  100.0,
+			"@mod:test":    50.0,
+			"@mod2:test":   50.0,
+			"@helper:test": 40.0,
+		},
+		"kick": 40.0,
+		"ban":  50.0,
+	})
+	tests := []struct {
+		user, target      string
+		wantKick, wantBan bool
+	}{
+		{"@admin:test", "@mod:test", true, true},
+		{"@mod:test", "@user:test", true, true},
+		{"@mod:test", "@mod2:test", false, false}, // same level
+		{"@mod:test", "@admin:test", false, false},
+		{"@helper:test", "@user:test", true, false}, // enough to kick, not to ban
+		{"@user:test", "@other:test", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user+" "+tt.target, func(t *testing.T) {
+			if got := room.CanKick(tt.user, tt.target); got != tt.wantKick {
+				t.Errorf("CanKick() = %t, want %t", got, tt.wantKick)
+			}
+			if got := room.CanBan(tt.user, tt.target); got != tt.wantBan {
+				t.Errorf("CanBan() = %t, want %t", got, tt.wantBan)
+			}
+		})
+	}
+}
+
+func TestPowerLevels(t *testing.T) {
+	tests := []struct {
+		name    string
+		content map[string]interface{}
+		want    PowerLevels
+	}{
+		{"no power levels event", nil,
+			PowerLevels{Users: map[string]int{"@creator:test": 100}, Ban: 50, Kick: 50, Redact: 50}},
+		{"defaults", map[string]interface{}{},
+			PowerLevels{StateDefault: 50, Ban: 50, Kick: 50, Redact: 50}},
+		{"numbers", map[string]interface{}{"users": map[string]interface{}{"@a:test": 100.0}, "ban": 75.0, "invite": 10.0},
+			PowerLevels{Users: map[string]int{"@a:test": 100}, StateDefault: 50, Ban: 75, Kick: 50, Redact: 50, Invite: 10}},
+		{"strings", map[string]interface{}{"users": map[string]interface{}{"@a:test": "100"}, "kick": "25", "events": map[string]interface{}{"m.room.name": " 60 "}},
+			PowerLevels{Users: map[string]int{"@a:test": 100}, Events: map[string]int{"m.room.name": 60}, StateDefault: 50, Ban: 50, Kick: 25, Redact: 50}},
+		{"invalid values keep their defaults", map[string]interface{}{"users": map[string]interface{}{"@a:test": "high", "@b:test": 50.0}, "ban": true, "kick": 0.0},
+			PowerLevels{Users: map[string]int{"@b:test": 50}, StateDefault: 50, Ban: 50, Kick: 0, Redact: 50}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := testPowerLevelsRoom(tt.content).PowerLevels()
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("PowerLevels() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetUserPowerLevel(t *testing.T) {
+	tests := []struct {
+		name        string
+		powerLevels map[string]interface{} // nil if the room has none
+		create      map[string]interface{}
+		userID      string
+		level       int
+		want        map[string]interface{}
+	}{
+		{"existing", map[string]interface{}{"users": map[string]interface{}{"@alice:test": 100}, "ban": 60},
+			nil, "@bot:test", 50,
+			map[string]interface{}{"users": map[string]interface{}{"@alice:test": 100.0, "@bot:test": 50.0}, "ban": 60.0}},
+		{"default level", map[string]interface{}{"users": map[string]interface{}{"@alice:test": 100, "@bot:test": 50}},
+			nil, "@bot:test", 0,
+			map[string]interface{}{"users": map[string]interface{}{"@alice:test": 100.0}}},
+		{"no power levels", nil, map[string]interface{}{"creator": "@alice:test"}, "@bot:test", 50,
+			map[string]interface{}{"users": map[string]interface{}{"@alice:test": 100.0, "@bot:test": 50.0}, "state_default": 0.0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent map[string]interface{}
+			mux := http.NewServeMux()
+			mux.HandleFunc("/_api/client/r0/rooms/!room:test/state/m.room.power_levels", func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == "PUT" {
+					if err := json.NewDecoder(r.Body).Decode(&sent); err != nil {
+						t.Error(err)
+					}
+					json.NewEncoder(w).Encode(RespSendEvent{EventID: "$power"})
+					return
+				}
+				if tt.powerLevels == nil {
+					w.WriteHeader(http.StatusNotFound)
+					json.NewEncoder(w).Encode(RespError{ErrCode: "M_NOT_FOUND", Err: "not found"})
+					return
+				}
+				json.NewEncoder(w).Encode(tt.powerLevels)
+			})
+			mux.HandleFunc("/_api/client/r0/rooms/!room:test/state/m.room.create", func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(tt.create)
+			})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+			cli := &Client{Endpoint: server.URL, AccessToken: "token", PathPrefix: "/_api/client/r0", httpClient: http.DefaultClient}
+
+			if _, err := cli.SetUserPowerLevel("!room:test", tt.userID, tt.level); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sent, tt.want) {
+				t.Errorf("sent %v, want %v", sent, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package sdnclient
+
+import (
+	"context"
+	"time"
+)
+
+// Presence is the presence of a user, from an m.presence event.
+type Presence struct {
+	UserID          string    `json:"user_id"`
+	Presence        string    `json:"presence"` // "online", "offline" or "unavailable"
+	StatusMsg       string    `json:"status_msg,omitempty"`
+	LastActiveAgo   int64     `json:"last_active_ago,omitempty"` // Milliseconds before Received
+	CurrentlyActive bool      `json:"currently_active,omitempty"`
+	Received        time.Time `json:"received"` // When the presence was received
+}
+
+// ParsePresence parses an m.presence event. It returns nil if the event isn't a presence event.
+func ParsePresence(event *Event) *Presence {
+	if event.Type != "m.presence" {
+		return nil
+	}
+	p := &Presence{UserID: event.Sender, Received: time.Now()}
+	p.Presence, _ = event.Content["presence"].(string)
+	p.StatusMsg, _ = event.Content["status_msg"].(string)
+	if lastActiveAgo, ok := event.Content["last_active_ago"].(float64); ok {
+		p.LastActiveAgo = int64(lastActiveAgo)
+	}
+	p.CurrentlyActive, _ = event.Content["currently_active"].(bool)
+	return p
+}
+
+// IsOnline returns true if the user is online.
+func (p *Presence) IsOnline() bool {
+	return p.Presence == "online"
+}
+
+// SetPresence sets the presence of the current user: "online", "offline" or "unavailable", with an optional
+// status message.
+func (cli *Client) SetPresence(presence, statusMsg string) (err error) {
+	return cli.SetPresenceWithContext(context.Background(), presence, statusMsg)
+}
+
+// SetPresenceWithContext is like SetPresence but with a context.
+func (cli *Client) SetPresenceWithContext(ctx context.Context, presence, statusMsg string) (err error) {
+	urlPath := cli.BuildURL("presence", cli.getUserID(), "status")
+	err = cli.MakeRequestWithContext(ctx, "PUT", urlPath, &ReqPresence{Presence: presence, StatusMsg: statusMsg}, nil)
+	return
+}
+
+// GetPresence returns the presence of the given user.
+func (cli *Client) GetPresence(userID string) (resp *RespPresence, err error) {
+	return cli.GetPresenceWithContext(context.Background(), userID)
+}
+
+// GetPresenceWithContext is like GetPresence but with a context.
+func (cli *Client) GetPresenceWithContext(ctx context.Context, userID string) (resp *RespPresence, err error) {
+	urlPath := cli.BuildURL("presence", userID, "status")
+	err = cli.MakeRequestWithContext(ctx, "GET", urlPath, nil, &resp)
+	return
+}
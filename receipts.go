@@ -0,0 +1,91 @@
+package sdnclient
+
+import (
+	"context"
+	"time"
+)
+
+// Receipt is a single receipt from an m.receipt event.
+type Receipt struct {
+	EventID   string `json:"event_id"`
+	UserID    string `json:"user_id"`
+	Type      string `json:"type"` // e.g. "m.read" or "m.read.private"
+	Timestamp int64  `json:"ts,omitempty"`
+	ThreadID  string `json:"thread_id,omitempty"`
+}
+
+// ParseReceipts parses the content of an m.receipt event, which maps event IDs to receipt types to user IDs.
+func ParseReceipts(event *Event) []Receipt {
+	var receipts []Receipt
+	for eventID, byType := range event.Content {
+		byTypeMap, _ := byType.(map[string]interface{})
+		for receiptType, byUser := range byTypeMap {
+			byUserMap, _ := byUser.(map[string]interface{})
+			for userID, data := range byUserMap {
+				receipt := Receipt{EventID: eventID, UserID: userID, Type: receiptType}
+				if dataMap, ok := data.(map[string]interface{}); ok {
+					if ts, ok := dataMap["ts"].(float64); ok {
+						receipt.Timestamp = int64(ts)
+					}
+					receipt.ThreadID, _ = dataMap["thread_id"].(string)
+				}
+				receipts = append(receipts, receipt)
+			}
+		}
+	}
+	return receipts
+}
+
+// ParseTyping parses the content of an m.typing event, returning the users currently typing.
+func ParseTyping(event *Event) []string {
+	values, _ := event.Content["user_ids"].([]interface{})
+	userIDs := make([]string, 0, len(values))
+	for _, value := range values {
+		if userID, ok := value.(string); ok {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs
+}
+
+// SendTyping tells the room whether the current user is typing. The typing notification lasts for timeout
+// unless it is renewed or stopped.
+func (cli *Client) SendTyping(roomID string, typing bool, timeout time.Duration) (err error) {
+	return cli.SendTypingWithContext(context.Background(), roomID, typing, timeout)
+}
+
+// SendTypingWithContext is like SendTyping but with a context.
+func (cli *Client) SendTypingWithContext(ctx context.Context, roomID string, typing bool, timeout time.Duration) (err error) {
+	req := &ReqTyping{Typing: typing}
+	if typing {
+		req.Timeout = timeout.Milliseconds()
+	}
+	urlPath := cli.BuildURL("rooms", roomID, "typing", cli.getUserID())
+	err = cli.MakeRequestWithContext(ctx, "PUT", urlPath, req, nil)
+	return
+}
+
+// SendReceipt sends a receipt of the given type (e.g. "m.read") for an event.
+func (cli *Client) SendReceipt(roomID, eventID, receiptType string) (err error) {
+	return cli.SendReceiptWithContext(context.Background(), roomID, eventID, receiptType)
+}
+
+// SendReceiptWithContext is like SendReceipt but with a context.
+func (cli *Client) SendReceiptWithContext(ctx context.Context, roomID, eventID, receiptType string) (err error) {
+	urlPath := cli.BuildURL("rooms", roomID, "receipt", receiptType, eventID)
+	err = cli.MakeRequestWithContext(ctx, "POST", urlPath, struct{}{}, nil)
+	return
+}
+
+// SetReadMarkers moves the fully read marker and the read receipt of the current user in a room.
+// Either event ID may be empty to leave that marker untouched.
+func (cli *Client) SetReadMarkers(roomID, fullyRead, read string) (err error) {
+	return cli.SetReadMarkersWithContext(context.Background(), roomID, fullyRead, read)
+}
+
+// SetReadMarkersWithContext is like SetReadMarkers but with a context.
+func (cli *Client) SetReadMarkersWithContext(ctx context.Context, roomID, fullyRead, read string) (err error) {
+	urlPath := cli.BuildURL("rooms", roomID, "read_markers")
+	err = cli.MakeRequestWithContext(ctx, "POST", urlPath, &ReqSetReadMarkers{FullyRead: fullyRead, Read: read}, nil)
+	return
+}
@@ -0,0 +1,147 @@
+package sdnclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseReceipts(t *testing.T) {
+	tests := []struct {
+		name    string
+		content map[string]interface{}
+		want    []Receipt
+	}{
+		{"empty", map[string]interface{}{}, nil},
+		{"read", map[string]interface{}{
+			"$a": map[string]interface{}{
+				"m.read": map[string]interface{}{
+					"@alice:test": map[string]interface{}{"ts": 1000.0},
+					"@bob:test":   map[string]interface{}{"ts": 2000.0, "thread_id": "main"},
+				},
+			},
+		}, []Receipt{
+			{EventID: "$a", UserID: "@alice:test", Type: "m.read", Timestamp: 1000},
+			{EventID: "$a", UserID: "@bob:test", Type: "m.read", Timestamp: 2000, ThreadID: "main"},
+		}},
+		{"several events and types", map[string]interface{}{
+			"$a": map[string]interface{}{"m.read": map[string]interface{}{"@alice:test": map[string]interface{}{}}},
+			"$b": map[string]interface{}{"m.read.private": map[string]interface{}{"@alice:test": map[string]interface{}{"ts": 5.0}}},
+		}, []Receipt{
+			{EventID: "$a", UserID: "@alice:test", Type: "m.read"},
+			{EventID: "$b", UserID: "@alice:test", Type: "m.read.private", Timestamp: 5},
+		}},
+		{"malformed", map[string]interface{}{
+			"$a": "not an object",
+			"$b": map[string]interface{}{"m.read": []interface{}{"@alice:test"}},
+			"$c": map[string]interface{}{"m.read": map[string]interface{}{"@bob:test": "no data"}},
+		}, []Receipt{
+			{EventID: "$c", UserID: "@bob:test", Type: "m.read"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseReceipts(&Event{Type: "m.receipt", Content: tt.content})
+			// The content is a map, so the order of the receipts is random.
+			sort.Slice(got, func(i, j int) bool {
+				if got[i].EventID != got[j].EventID {
+					return got[i].EventID < got[j].EventID
+				}
+				return got[i].UserID < got[j].UserID
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseReceipts() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoomReadBy(t *testing.T) {
+	inThread := func(id string) *Event {
+		return &Event{ID: id, Content: map[string]interface{}{
+			"m.relates_to": map[string]interface{}{"rel_type": "m.thread", "event_id": "$root"},
+		}}
+	}
+	room := NewRoom("!room:test")
+	for _, event := range []*Event{{ID: "$a"}, {ID: "$b"}, {ID: "$root"}, inThread("$t1"), {ID: "$c"}, inThread("$t2")} {
+		room.AddTimelineEvent(event)
+	}
+	room.UpdateReceipts([]Receipt{
+		{EventID: "$b", UserID: "@alice:test", Type: "m.read"},
+		{EventID: "$c", UserID: "@bob:test", Type: "m.read.private", ThreadID: "main"},
+		{EventID: "$t1", UserID: "@bob:test", Type: "m.read.private", ThreadID: "$root"},
+		{EventID: "$t1", UserID: "@carol:test", Type: "m.read", ThreadID: "$root"},
+		{EventID: "$t2", UserID: "@dave:test", Type: "m.read"},
+		{EventID: "$old", UserID: "@erin:test", Type: "m.read"},
+		{EventID: "$c", UserID: "@frank:test", Type: "m.read", ThreadID: "main"},
+	})
+	// An older receipt doesn't move the read marker back.
+	room.UpdateReceipts([]Receipt{{EventID: "$a", UserID: "@frank:test", Type: "m.read"}})
+
+	tests := []struct {
+		eventID string
+		want    []string
+	}{
+		{"$a", []string{"@alice:test", "@bob:test", "@dave:test", "@frank:test"}},
+		{"$b", []string{"@alice:test", "@bob:test", "@dave:test", "@frank:test"}},
+		{"$c", []string{"@bob:test", "@dave:test", "@frank:test"}},
+		{"$t1", []string{"@bob:test", "@carol:test", "@dave:test"}},
+		{"$t2", []string{"@dave:test"}},
+		{"$old", []string{"@erin:test"}},
+		{"$unknown", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.eventID, func(t *testing.T) {
+			if got := room.ReadBy(tt.eventID); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadBy(%s) = %v, want %v", tt.eventID, got, tt.want)
+			}
+		})
+	}
+
+	if receipt, ok := room.GetReceipt("@bob:test", "m.read.private"); !ok || receipt.EventID != "$c" {
+		t.Errorf("GetReceipt() = %+v, %t, want the main timeline receipt at $c", receipt, ok)
+	}
+	if receipt, ok := room.GetThreadReceipt("@bob:test", "m.read.private", "$root"); !ok || receipt.EventID != "$t1" {
+		t.Errorf("GetThreadReceipt() = %+v, %t, want the thread receipt at $t1", receipt, ok)
+	}
+	if _, ok := room.GetReceipt("@carol:test", "m.read"); ok {
+		t.Error("a thread receipt was recorded as a main timeline receipt")
+	}
+}
+
+func TestRoomTimelineReload(t *testing.T) {
+	room := NewRoom("!room:test")
+	room.AddTimelineEvent(&Event{ID: "$a"})
+	room.AddTimelineEvent(&Event{ID: "$b"})
+	data, err := json.Marshal(room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reloaded Room
+	if err := json.Unmarshal(data, &reloaded); err != nil {
+		t.Fatal(err)
+	}
+	reloaded.AddTimelineEvent(&Event{ID: "$c"})
+	reloaded.UpdateReceipts([]Receipt{{EventID: "$c", UserID: "@alice:test", Type: "m.read"}})
+	if got, want := reloaded.ReadBy("$b"), []string{"@alice:test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadBy($b) = %v, want %v", got, want)
+	}
+}
+
+func TestRoomTimelineLimit(t *testing.T) {
+	room := NewRoom("!room:test")
+	for i := 0; i < 2*maxTimelinePositions; i++ {
+		room.AddTimelineEvent(&Event{ID: fmt.Sprintf("$%d", i)})
+	}
+	if n := len(room.Timeline); n < maxTimelinePositions || n > maxTimelinePositions+maxTimelinePositions/10 {
+		t.Errorf("the room remembers %d timeline events", n)
+	}
+	if _, ok := room.Timeline[fmt.Sprintf("$%d", 2*maxTimelinePositions-1)]; !ok {
+		t.Error("the latest event was forgotten")
+	}
+	if _, ok := room.Timeline["$0"]; ok {
+		t.Error("the oldest event wasn't forgotten")
+	}
+}
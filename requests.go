@@ -31,3 +31,59 @@ type ReqKickUser struct {
 	Reason string `json:"reason,omitempty"`
 	UserID string `json:"user_id"`
 }
+
+// ReqBanUser is the JSON request for ban user
+type ReqBanUser struct {
+	Reason string `json:"reason,omitempty"`
+	UserID string `json:"user_id"`
+}
+
+// ReqUnbanUser is the JSON request for unban user
+type ReqUnbanUser struct {
+	Reason string `json:"reason,omitempty"`
+	UserID string `json:"user_id"`
+}
+
+// ReqDeleteDevices is the JSON request for DeleteDevices
+type ReqDeleteDevices struct {
+	Devices []string    `json:"devices"`
+	Auth    interface{} `json:"auth,omitempty"`
+}
+
+// ReqDeleteDevice is the JSON request for DeleteDevice
+type ReqDeleteDevice struct {
+	Auth interface{} `json:"auth,omitempty"`
+}
+
+// ReqSetDeviceDisplayName is the JSON request for SetDeviceDisplayName
+type ReqSetDeviceDisplayName struct {
+	DisplayName string `json:"display_name"`
+}
+
+// ReqRedact is the JSON request for redact event
+type ReqRedact struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// ReqPresence is the JSON request for set presence
+type ReqPresence struct {
+	Presence  string `json:"presence"`
+	StatusMsg string `json:"status_msg,omitempty"`
+}
+
+// ReqTyping is the JSON request for send typing
+type ReqTyping struct {
+	Typing  bool  `json:"typing"`
+	Timeout int64 `json:"timeout,omitempty"`
+}
+
+// ReqSetReadMarkers is the JSON request for set read markers
+type ReqSetReadMarkers struct {
+	FullyRead string `json:"m.fully_read,omitempty"`
+	Read      string `json:"m.read,omitempty"`
+}
+
+// ReqSendToDevice is the JSON request for send to device
+type ReqSendToDevice struct {
+	Messages map[string]map[string]interface{} `json:"messages"`
+}
@@ -2,8 +2,9 @@ package sdnclient
 
 // RespError is the standard JSON error response from SDN node servers
 type RespError struct {
-	ErrCode string `json:"errcode"`
-	Err     string `json:"error"`
+	ErrCode      string `json:"errcode"`
+	Err          string `json:"error"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"` // Only present for M_LIMIT_EXCEEDED
 }
 
 // Error returns the errcode and error message.
@@ -25,6 +26,15 @@ type RespInviteUser struct{}
 // RespKickUser is the JSON response for KickUser
 type RespKickUser struct{}
 
+// RespBanUser is the JSON response for BanUser
+type RespBanUser struct{}
+
+// RespUnbanUser is the JSON response for UnbanUser
+type RespUnbanUser struct{}
+
+// RespForgetRoom is the JSON response for ForgetRoom
+type RespForgetRoom struct{}
+
 // RespJoinedRooms is the JSON response for JoinedRooms
 type RespJoinedRooms struct {
 	JoinedRooms []string `json:"joined_rooms"`
@@ -43,6 +53,11 @@ type RespSendEvent struct {
 	EventID string `json:"event_id"`
 }
 
+// RespMediaUpload is the JSON response for UploadMedia
+type RespMediaUpload struct {
+	ContentURI string `json:"content_uri"`
+}
+
 // RespLogout is the JSON response for Logout
 type RespLogout struct{}
 
@@ -56,6 +71,58 @@ type RespUserDisplayName struct {
 	DisplayName string `json:"displayname"`
 }
 
+// RespDevice is the JSON response for GetDevice
+type RespDevice struct {
+	DeviceID    string `json:"device_id"`
+	DisplayName string `json:"display_name"`
+	LastSeenIP  string `json:"last_seen_ip"`
+	LastSeenTS  int64  `json:"last_seen_ts"`
+}
+
+// RespDevices is the JSON response for GetDevices
+type RespDevices struct {
+	Devices []RespDevice `json:"devices"`
+}
+
+// RespUserInteractive is the JSON response for endpoints which require user-interactive authentication,
+// returned with HTTP 401 until the auth flow is completed.
+type RespUserInteractive struct {
+	Flows []struct {
+		Stages []string `json:"stages"`
+	} `json:"flows"`
+	Params    map[string]interface{} `json:"params"`
+	Session   string                 `json:"session"`
+	Completed []string               `json:"completed"`
+	ErrCode   string                 `json:"errcode"`
+	Error     string                 `json:"error"`
+}
+
+// HasSingleStageFlow returns true if there exists at least 1 Flow with a single stage of stageName.
+func (r RespUserInteractive) HasSingleStageFlow(stageName string) bool {
+	for _, f := range r.Flows {
+		if len(f.Stages) == 1 && f.Stages[0] == stageName {
+			return true
+		}
+	}
+	return false
+}
+
+// RespMessages is the JSON response for Messages
+type RespMessages struct {
+	Start string  `json:"start"`
+	Chunk []Event `json:"chunk"`
+	State []Event `json:"state"`
+	End   string  `json:"end"`
+}
+
+// RespPresence is the JSON response for GetPresence
+type RespPresence struct {
+	Presence        string `json:"presence"`
+	LastActiveAgo   int64  `json:"last_active_ago,omitempty"`
+	StatusMsg       string `json:"status_msg,omitempty"`
+	CurrentlyActive bool   `json:"currently_active,omitempty"`
+}
+
 type RespCreateFilter struct {
 	FilterID string `json:"filter_id"`
 }
@@ -69,8 +136,14 @@ type RespSync struct {
 	Presence struct {
 		Events []Event `json:"events"`
 	} `json:"presence"`
+	ToDevice struct {
+		Events []Event `json:"events"`
+	} `json:"to_device"`
 	Rooms struct {
 		Leave map[string]struct {
+			AccountData struct {
+				Events []Event `json:"events"`
+			} `json:"account_data"`
 			State struct {
 				Events []Event `json:"events"`
 			} `json:"state"`
@@ -81,6 +154,9 @@ type RespSync struct {
 			} `json:"timeline"`
 		} `json:"leave"`
 		Join map[string]struct {
+			AccountData struct {
+				Events []Event `json:"events"`
+			} `json:"account_data"`
 			State struct {
 				Events []Event `json:"events"`
 			} `json:"state"`
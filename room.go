@@ -1,11 +1,43 @@
 package sdnclient
 
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
 // Room represents a single room.
+//
+// Room is safe for concurrent use as long as State is only accessed through its methods, which return
+// copies of the stored events.
 type Room struct {
-	ID    string
-	State map[string]map[string]*Event
+	ID    string                       `json:"room_id"`
+	State map[string]map[string]*Event `json:"state"`
+	// Receipts maps receipt types to user IDs to the latest unthreaded or main timeline receipt of the user.
+	Receipts map[string]map[string]Receipt `json:"receipts,omitempty"`
+	// ThreadReceipts maps thread IDs to receipt types to user IDs to the latest receipt of the user in the thread.
+	ThreadReceipts map[string]map[string]map[string]Receipt `json:"thread_receipts,omitempty"`
+	// Timeline maps the IDs of the latest maxTimelinePositions timeline events to their position.
+	Timeline    map[string]TimelinePosition `json:"timeline,omitempty"`
+	timelineEnd int64                       // position of the next timeline event, 0 until computed from Timeline
+	mutex       sync.RWMutex                // protects State, Receipts, ThreadReceipts and Timeline
+}
+
+// TimelinePosition is the position of an event in the timeline of a room, which tells whether a receipt at
+// another event covers it.
+type TimelinePosition struct {
+	Index    int64  `json:"index"`
+	ThreadID string `json:"thread_id,omitempty"` // the thread root, for events sent in a thread
 }
 
+// maxTimelinePositions is the number of timeline events whose position a room remembers.
+const maxTimelinePositions = 10000
+
+// mainThreadID is the thread ID of receipts for the main timeline, as opposed to unthreaded receipts.
+const mainThreadID = "main"
+
 // PublicRoom represents the information about a public room obtainable from the room directory
 type PublicRoom struct {
 	CanonicalAlias   string   `json:"canonical_alias"`
@@ -20,27 +52,71 @@ type PublicRoom struct {
 }
 
 // UpdateState updates the room's current state with the given Event. This will clobber events based
-// on the type/state_key combination.
-func (room Room) UpdateState(event *Event) {
+// on the type/state_key combination. The room keeps a copy of the event.
+func (room *Room) UpdateState(event *Event) {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
 	_, exists := room.State[event.Type]
 	if !exists {
 		room.State[event.Type] = make(map[string]*Event)
 	}
-	room.State[event.Type][*event.StateKey] = event
+	room.State[event.Type][*event.StateKey] = event.copy()
+}
+
+// GetStateEvent returns a copy of the state event for the given type/state_key combo, or nil.
+func (room *Room) GetStateEvent(eventType string, stateKey string) *Event {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	return room.getStateEvent(eventType, stateKey).copy()
 }
 
-// GetStateEvent returns the state event for the given type/state_key combo, or nil.
-func (room Room) GetStateEvent(eventType string, stateKey string) *Event {
+// getStateEvent returns the stored state event for the given type/state_key combo, or nil.
+// The caller must hold the mutex and must not modify or leak the event.
+func (room *Room) getStateEvent(eventType string, stateKey string) *Event {
 	stateEventMap := room.State[eventType]
 	event := stateEventMap[stateKey]
 	return event
 }
 
+// Redact applies the given m.room.redaction event to the room state. It returns a copy of the redacted state
+// event as it was before the redaction, or nil if the redacted event isn't part of the room state.
+func (room *Room) Redact(redaction *Event) *Event {
+	redactedID := redaction.RedactedEventID()
+	if redactedID == "" {
+		return nil
+	}
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	for _, events := range room.State {
+		for _, event := range events {
+			if event.ID == redactedID {
+				original := event.copy()
+				event.redact(redaction)
+				return original
+			}
+		}
+	}
+	return nil
+}
+
+// GetStateEvents returns copies of all state events of the given type, keyed by state key.
+func (room *Room) GetStateEvents(eventType string) map[string]*Event {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	events := make(map[string]*Event, len(room.State[eventType]))
+	for stateKey, event := range room.State[eventType] {
+		events[stateKey] = event.copy()
+	}
+	return events
+}
+
 // GetMembershipState returns the membership state of the given user ID in this room. If there is
 // no entry for this member, 'leave' is returned for consistency with left users.
-func (room Room) GetMembershipState(userID string) string {
+func (room *Room) GetMembershipState(userID string) string {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
 	state := "leave"
-	event := room.GetStateEvent("m.room.member", userID)
+	event := room.getStateEvent("m.room.member", userID)
 	if event != nil {
 		membershipState, found := event.Content["membership"]
 		if found {
@@ -53,11 +129,320 @@ func (room Room) GetMembershipState(userID string) string {
 	return state
 }
 
+// Member represents a member of a room, from its m.room.member state event.
+type Member struct {
+	UserID      string
+	DisplayName string
+	AvatarURL   string
+	Membership  string
+}
+
+// contentString returns the string value of key in the content of the given state event, or "".
+func (room *Room) contentString(eventType, stateKey, key string) string {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	event := room.getStateEvent(eventType, stateKey)
+	if event == nil {
+		return ""
+	}
+	value, _ := event.Content[key].(string)
+	return value
+}
+
+// Name returns the name of the room from m.room.name, or "" if it has none.
+func (room *Room) Name() string {
+	return room.contentString("m.room.name", "", "name")
+}
+
+// Topic returns the topic of the room from m.room.topic, or "" if it has none.
+func (room *Room) Topic() string {
+	return room.contentString("m.room.topic", "", "topic")
+}
+
+// AvatarURL returns the avatar URL of the room from m.room.avatar, or "" if it has none.
+func (room *Room) AvatarURL() string {
+	return room.contentString("m.room.avatar", "", "url")
+}
+
+// CanonicalAlias returns the canonical alias of the room from m.room.canonical_alias, or "" if it has none.
+func (room *Room) CanonicalAlias() string {
+	return room.contentString("m.room.canonical_alias", "", "alias")
+}
+
+// AltAliases returns the alternative aliases of the room from m.room.canonical_alias.
+func (room *Room) AltAliases() []string {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	event := room.getStateEvent("m.room.canonical_alias", "")
+	if event == nil {
+		return nil
+	}
+	values, _ := event.Content["alt_aliases"].([]interface{})
+	var aliases []string
+	for _, value := range values {
+		if alias, ok := value.(string); ok {
+			aliases = append(aliases, alias)
+		}
+	}
+	return aliases
+}
+
+// JoinRule returns the join rule of the room from m.room.join_rules, e.g. "public" or "invite".
+// Rooms without join rules are "invite" only.
+func (room *Room) JoinRule() string {
+	if joinRule := room.contentString("m.room.join_rules", "", "join_rule"); joinRule != "" {
+		return joinRule
+	}
+	return "invite"
+}
+
+// HistoryVisibility returns the history visibility of the room from m.room.history_visibility, e.g. "shared".
+// Rooms without history visibility are "shared".
+func (room *Room) HistoryVisibility() string {
+	if visibility := room.contentString("m.room.history_visibility", "", "history_visibility"); visibility != "" {
+		return visibility
+	}
+	return "shared"
+}
+
+// Members returns the members of the room with the given membership, e.g. "join", sorted by user ID.
+// If membership is empty, all members are returned.
+func (room *Room) Members(membership string) []Member {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	var members []Member
+	for userID, event := range room.State["m.room.member"] {
+		member := Member{UserID: userID}
+		member.Membership, _ = event.Content["membership"].(string)
+		if membership != "" && member.Membership != membership {
+			continue
+		}
+		member.DisplayName, _ = event.Content["displayname"].(string)
+		member.AvatarURL, _ = event.Content["avatar_url"].(string)
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].UserID < members[j].UserID
+	})
+	return members
+}
+
+// DisplayName returns a human-friendly name for the room as seen by ownUserID: its name, its canonical alias,
+// or a summary of the names of the other members, e.g. "Alice, Bob and 3 others".
+func (room *Room) DisplayName(ownUserID string) string {
+	if name := room.Name(); name != "" {
+		return name
+	}
+	if alias := room.CanonicalAlias(); alias != "" {
+		return alias
+	}
+
+	var heroes, left []Member
+	for _, member := range room.Members("") {
+		if member.UserID == ownUserID {
+			continue
+		}
+		switch member.Membership {
+		case "join", "invite":
+			heroes = append(heroes, member)
+		case "leave", "ban":
+			left = append(left, member)
+		}
+	}
+	if len(heroes) == 0 {
+		if len(left) == 0 {
+			return "Empty Room"
+		}
+		return "Empty Room (was " + summarizeMembers(left) + ")"
+	}
+	return summarizeMembers(heroes)
+}
+
+// maxHeroes is the number of member names shown by Room.DisplayName.
+const maxHeroes = 5
+
+// summarizeMembers joins the names of up to maxHeroes members, e.g. "Alice, Bob and 3 others".
+func summarizeMembers(members []Member) string {
+	displayNameCount := make(map[string]int)
+	for _, member := range members {
+		displayNameCount[member.DisplayName]++
+	}
+	var names []string
+	for i, member := range members {
+		if i == maxHeroes {
+			break
+		}
+		name := member.DisplayName
+		if name == "" {
+			name = member.UserID
+		} else if displayNameCount[name] > 1 {
+			// Disambiguate members using the same display name.
+			name = name + " (" + member.UserID + ")"
+		}
+		names = append(names, name)
+	}
+	if others := len(members) - len(names); others == 1 {
+		return strings.Join(names, ", ") + " and 1 other"
+	} else if others > 1 {
+		return strings.Join(names, ", ") + " and " + strconv.Itoa(others) + " others"
+	}
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// AddTimelineEvent records the position of the given event after the previously added events. Events must
+// be added in timeline order. Events which are already known keep their position.
+func (room *Room) AddTimelineEvent(event *Event) {
+	if event.ID == "" {
+		return
+	}
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	if room.Timeline == nil {
+		room.Timeline = make(map[string]TimelinePosition)
+	}
+	if _, exists := room.Timeline[event.ID]; exists {
+		return
+	}
+	if room.timelineEnd == 0 {
+		// The room was loaded from a store, continue after its latest event.
+		for _, position := range room.Timeline {
+			if position.Index >= room.timelineEnd {
+				room.timelineEnd = position.Index + 1
+			}
+		}
+	}
+	room.Timeline[event.ID] = TimelinePosition{Index: room.timelineEnd, ThreadID: event.ThreadID()}
+	room.timelineEnd++
+	// Forget the oldest events in batches, so that the map isn't scanned for every event.
+	if len(room.Timeline) > maxTimelinePositions+maxTimelinePositions/10 {
+		for eventID, position := range room.Timeline {
+			if position.Index < room.timelineEnd-maxTimelinePositions {
+				delete(room.Timeline, eventID)
+			}
+		}
+	}
+}
+
+// isBefore returns true if both events are in the known timeline and eventID comes before otherEventID.
+// The caller must hold the mutex.
+func (room *Room) isBefore(eventID, otherEventID string) bool {
+	position, ok := room.Timeline[eventID]
+	otherPosition, otherOK := room.Timeline[otherEventID]
+	return ok && otherOK && position.Index < otherPosition.Index
+}
+
+// UpdateReceipts records the given receipts as the latest receipts of their users. Receipts in a thread are
+// kept apart from unthreaded and main timeline receipts. A receipt at an earlier event than the recorded one
+// is ignored.
+func (room *Room) UpdateReceipts(receipts []Receipt) {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	if room.Receipts == nil {
+		room.Receipts = make(map[string]map[string]Receipt)
+	}
+	for _, receipt := range receipts {
+		byType := room.Receipts
+		if receipt.ThreadID != "" && receipt.ThreadID != mainThreadID {
+			if room.ThreadReceipts == nil {
+				room.ThreadReceipts = make(map[string]map[string]map[string]Receipt)
+			}
+			if room.ThreadReceipts[receipt.ThreadID] == nil {
+				room.ThreadReceipts[receipt.ThreadID] = make(map[string]map[string]Receipt)
+			}
+			byType = room.ThreadReceipts[receipt.ThreadID]
+		}
+		if byType[receipt.Type] == nil {
+			byType[receipt.Type] = make(map[string]Receipt)
+		}
+		if previous, ok := byType[receipt.Type][receipt.UserID]; ok && room.isBefore(receipt.EventID, previous.EventID) {
+			continue
+		}
+		byType[receipt.Type][receipt.UserID] = receipt
+	}
+}
+
+// GetReceipt returns the latest unthreaded or main timeline receipt of the given type (e.g. "m.read") sent by
+// a user in the room.
+func (room *Room) GetReceipt(userID, receiptType string) (Receipt, bool) {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	receipt, ok := room.Receipts[receiptType][userID]
+	return receipt, ok
+}
+
+// GetThreadReceipt returns the latest receipt of the given type sent by a user in the thread with the given
+// root event ID.
+func (room *Room) GetThreadReceipt(userID, receiptType, threadID string) (Receipt, bool) {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	receipt, ok := room.ThreadReceipts[threadID][receiptType][userID]
+	return receipt, ok
+}
+
+// ReadBy returns the users who have read the given event, sorted by user ID: those whose public or private
+// read receipt is at this event or at a later event of the timeline. Unthreaded receipts cover every event,
+// main timeline receipts cover the events outside threads and thread receipts the events of their thread.
+// The room only knows the position of the timeline events it has seen, so for older events only receipts
+// exactly at the event count.
+func (room *Room) ReadBy(eventID string) []string {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	position, known := room.Timeline[eventID]
+	seen := make(map[string]bool)
+	var userIDs []string
+	addReaders := func(byType map[string]map[string]Receipt, unthreadedOnly bool) {
+		for _, receiptType := range []string{"m.read", "m.read.private"} {
+			for userID, receipt := range byType[receiptType] {
+				if seen[userID] || (unthreadedOnly && receipt.ThreadID != "") {
+					continue
+				}
+				receiptPosition, receiptKnown := room.Timeline[receipt.EventID]
+				if receipt.EventID == eventID || (known && receiptKnown && receiptPosition.Index >= position.Index) {
+					seen[userID] = true
+					userIDs = append(userIDs, userID)
+				}
+			}
+		}
+	}
+	switch {
+	case !known:
+		addReaders(room.Receipts, false)
+		for _, byType := range room.ThreadReceipts {
+			addReaders(byType, false)
+		}
+	case position.ThreadID == "":
+		addReaders(room.Receipts, false)
+	default:
+		addReaders(room.Receipts, true)
+		addReaders(room.ThreadReceipts[position.ThreadID], false)
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
+// MarshalJSON encodes the room while holding its lock, so that it can be persisted while in use.
+func (room *Room) MarshalJSON() ([]byte, error) {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	return json.Marshal(struct {
+		ID             string                                   `json:"room_id"`
+		State          map[string]map[string]*Event             `json:"state"`
+		Receipts       map[string]map[string]Receipt            `json:"receipts,omitempty"`
+		ThreadReceipts map[string]map[string]map[string]Receipt `json:"thread_receipts,omitempty"`
+		Timeline       map[string]TimelinePosition              `json:"timeline,omitempty"`
+	}{room.ID, room.State, room.Receipts, room.ThreadReceipts, room.Timeline})
+}
+
 // NewRoom creates a new Room with the given ID
 func NewRoom(roomID string) *Room {
 	// Init the State map and return a pointer to the Room
 	return &Room{
-		ID:    roomID,
-		State: make(map[string]map[string]*Event),
+		ID:       roomID,
+		State:    make(map[string]map[string]*Event),
+		Receipts: make(map[string]map[string]Receipt),
+		Timeline: make(map[string]TimelinePosition),
 	}
 }
@@ -0,0 +1,71 @@
+package sdnclient
+
+import "testing"
+
+func TestSummarizeMembers(t *testing.T) {
+	member := func(userID, displayName string) Member {
+		return Member{UserID: userID, DisplayName: displayName, Membership: "join"}
+	}
+	alice := member("@alice:test", "Alice")
+	bob := member("@bob:test", "Bob")
+	carol := member("@carol:test", "Carol")
+	dave := member("@dave:test", "Dave")
+	erin := member("@erin:test", "Erin")
+	frank := member("@frank:test", "Frank")
+	grace := member("@grace:test", "Grace")
+
+	tests := []struct {
+		name    string
+		members []Member
+		want    string
+	}{
+		{"one", []Member{alice}, "Alice"},
+		{"two", []Member{alice, bob}, "Alice and Bob"},
+		{"three", []Member{alice, bob, carol}, "Alice, Bob and Carol"},
+		{"five", []Member{alice, bob, carol, dave, erin}, "Alice, Bob, Carol, Dave and Erin"},
+		{"six", []Member{alice, bob, carol, dave, erin, frank}, "Alice, Bob, Carol, Dave, Erin and 1 other"},
+		{"seven", []Member{alice, bob, carol, dave, erin, frank, grace}, "Alice, Bob, Carol, Dave, Erin and 2 others"},
+		{"no display name", []Member{member("@x:test", ""), bob}, "@x:test and Bob"},
+		{"same display name", []Member{member("@a1:test", "Alice"), member("@a2:test", "Alice")},
+			"Alice (@a1:test) and Alice (@a2:test)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := summarizeMembers(tt.members); got != tt.want {
+				t.Errorf("summarizeMembers() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoomDisplayName(t *testing.T) {
+	stateKey := func(s string) *string { return &s }
+	memberEvent := func(userID, membership, displayName string) *Event {
+		return &Event{Type: "m.room.member", StateKey: stateKey(userID), Sender: userID,
+			Content: map[string]interface{}{"membership": membership, "displayname": displayName}}
+	}
+
+	room := NewRoom("!room:test")
+	if got := room.DisplayName("@bot:test"); got != "Empty Room" {
+		t.Errorf("empty room: got %q", got)
+	}
+	room.UpdateState(memberEvent("@bot:test", "join", "Bot"))
+	room.UpdateState(memberEvent("@alice:test", "leave", "Alice"))
+	if got := room.DisplayName("@bot:test"); got != "Empty Room (was Alice)" {
+		t.Errorf("left room: got %q", got)
+	}
+	room.UpdateState(memberEvent("@bob:test", "invite", "Bob"))
+	if got := room.DisplayName("@bot:test"); got != "Bob" {
+		t.Errorf("invited member: got %q", got)
+	}
+	room.UpdateState(&Event{Type: "m.room.canonical_alias", StateKey: stateKey(""),
+		Content: map[string]interface{}{"alias": "#room:test"}})
+	if got := room.DisplayName("@bot:test"); got != "#room:test" {
+		t.Errorf("alias: got %q", got)
+	}
+	room.UpdateState(&Event{Type: "m.room.name", StateKey: stateKey(""),
+		Content: map[string]interface{}{"name": "Room"}})
+	if got := room.DisplayName("@bot:test"); got != "Room" {
+		t.Errorf("name: got %q", got)
+	}
+}
@@ -0,0 +1,177 @@
+package sdnclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethereumcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+// Signer is an interface which must be satisfied to sign the DID login message of a wallet.
+//
+// The provided implementations keep the key in memory (PrivateKeySigner), in a geth keystore file
+// (KeystoreSigner) or behind a JSON-RPC signing endpoint (RemoteSigner).
+type Signer interface {
+	// Address returns the wallet address of the signing key.
+	Address() string
+	// SignMessage returns the personal_sign (EIP-191) signature of message.
+	SignMessage(ctx context.Context, message []byte) ([]byte, error)
+}
+
+// PrivateKeySigner implements the Signer interface with an in-memory private key.
+type PrivateKeySigner struct {
+	key *ecdsa.PrivateKey
+}
+
+// NewPrivateKeySigner constructs a new PrivateKeySigner.
+func NewPrivateKeySigner(key *ecdsa.PrivateKey) *PrivateKeySigner {
+	return &PrivateKeySigner{key: key}
+}
+
+// NewPrivateKeySignerFromHex constructs a new PrivateKeySigner from a hex encoded private key.
+func NewPrivateKeySignerFromHex(hexKey string) (*PrivateKeySigner, error) {
+	key, err := ethereumcrypto.HexToECDSA(strings.TrimPrefix(hexKey, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	return NewPrivateKeySigner(key), nil
+}
+
+// Address returns the lower-case wallet address of the key.
+func (s *PrivateKeySigner) Address() string {
+	return strings.ToLower(ethereumcrypto.PubkeyToAddress(s.key.PublicKey).Hex())
+}
+
+// SignMessage signs message with the key.
+func (s *PrivateKeySigner) SignMessage(ctx context.Context, message []byte) ([]byte, error) {
+	return ethereumcrypto.Sign(accounts.TextHash(message), s.key)
+}
+
+// KeystoreSigner implements the Signer interface with a geth (V3) keystore file.
+//
+// The key is decrypted from the file for every signature and is not kept in memory.
+type KeystoreSigner struct {
+	path       string
+	passphrase string
+	address    string
+}
+
+// NewKeystoreSigner constructs a new KeystoreSigner. The file is decrypted once to check the passphrase.
+func NewKeystoreSigner(path, passphrase string) (*KeystoreSigner, error) {
+	s := &KeystoreSigner{path: path, passphrase: passphrase}
+	key, err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	s.address = strings.ToLower(key.Address.Hex())
+	zeroKey(key.PrivateKey)
+	return s, nil
+}
+
+func (s *KeystoreSigner) decrypt() (*keystore.Key, error) {
+	keyJSON, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return keystore.DecryptKey(keyJSON, s.passphrase)
+}
+
+// Address returns the lower-case wallet address of the keystore.
+func (s *KeystoreSigner) Address() string {
+	return s.address
+}
+
+// SignMessage decrypts the keystore and signs message with its key.
+func (s *KeystoreSigner) SignMessage(ctx context.Context, message []byte) ([]byte, error) {
+	key, err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	defer zeroKey(key.PrivateKey)
+	return ethereumcrypto.Sign(accounts.TextHash(message), key.PrivateKey)
+}
+
+// zeroKey overwrites the private part of key.
+func zeroKey(key *ecdsa.PrivateKey) {
+	b := key.D.Bits()
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// RemoteSigner implements the Signer interface with a JSON-RPC endpoint supporting personal_sign, such as
+// a local clef or geth node.
+type RemoteSigner struct {
+	Endpoint   string
+	address    string
+	httpClient *http.Client
+}
+
+// NewRemoteSigner constructs a new RemoteSigner which signs with the account address at endpoint.
+func NewRemoteSigner(endpoint, address string) *RemoteSigner {
+	return &RemoteSigner{
+		Endpoint:   endpoint,
+		address:    strings.ToLower(address),
+		httpClient: http.DefaultClient,
+	}
+}
+
+// Address returns the lower-case wallet address of the remote account.
+func (s *RemoteSigner) Address() string {
+	return s.address
+}
+
+// SignMessage calls personal_sign on the remote endpoint.
+func (s *RemoteSigner) SignMessage(ctx context.Context, message []byte) ([]byte, error) {
+	reqBody, err := json.Marshal(struct {
+		JSONRPC string        `json:"jsonrpc"`
+		ID      int           `json:"id"`
+		Method  string        `json:"method"`
+		Params  []interface{} `json:"params"`
+	}{"2.0", 1, "personal_sign", []interface{}{hexutil.Encode(message), s.address}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.Endpoint, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var resBody struct {
+		Result hexutil.Bytes `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+		return nil, fmt.Errorf("remote signer: %s: %w", res.Status, err)
+	}
+	if resBody.Error != nil {
+		return nil, fmt.Errorf("remote signer: %s (code %d)", resBody.Error.Message, resBody.Error.Code)
+	}
+	sig := []byte(resBody.Result)
+	if len(sig) != 65 {
+		return nil, fmt.Errorf("remote signer: invalid signature length %d", len(sig))
+	}
+	// personal_sign returns V as 27/28, normalize it to the 0/1 produced by the local signers.
+	if sig[64] >= 27 {
+		sig[64] -= 27
+	}
+	return sig, nil
+}
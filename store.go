@@ -1,10 +1,16 @@
 package sdnclient
 
+import "sync"
+
 // Storer is an interface which must be satisfied to store client data.
 //
-// You can either write a struct which persists this data to disk, or you can use the
-// provided "InMemoryStore" which just keeps data around in-memory which is lost on
-// restarts.
+// You can either write your own implementation, use the provided "FileStore" which persists
+// this data to disk, or use the provided "InMemoryStore" which just keeps data around in-memory
+// which is lost on restarts.
+//
+// SaveRoom is called again whenever the state of a room changed.
+//
+// A Storer may also implement AccountDataStorer and PresenceStorer, which DefaultSyncer uses when available.
 type Storer interface {
 	SaveFilterID(userID, filterID string)
 	LoadFilterID(userID string) string
@@ -14,52 +20,139 @@ type Storer interface {
 	LoadRoom(roomID string) *Room
 }
 
+// AccountDataStorer is an optional interface of a Storer which stores account data.
+// InMemoryStore and FileStore implement it.
+type AccountDataStorer interface {
+	// SaveAccountData saves an account data event. roomID is empty for global account data.
+	SaveAccountData(roomID string, event *Event)
+	LoadAccountData(roomID, eventType string) *Event
+}
+
+// PresenceStorer is an optional interface of a Storer which stores the presence of users.
+// InMemoryStore and FileStore implement it.
+type PresenceStorer interface {
+	SavePresence(presence *Presence)
+	LoadPresence(userID string) *Presence
+	// LoadPresences returns the presence of every known user, keyed by user ID.
+	LoadPresences() map[string]*Presence
+}
+
 // InMemoryStore implements the Storer interface.
 //
-// Everything is persisted in-memory as maps. It is not safe to load/save filter IDs
-// or next batch tokens on any goroutine other than the syncing goroutine: the one
-// which called Client.Sync().
+// Everything is persisted in-memory as maps. It is safe for concurrent use as long as
+// the maps are only accessed through its methods.
 type InMemoryStore struct {
-	Filters   map[string]string
-	NextBatch map[string]string
-	Rooms     map[string]*Room
+	Filters     map[string]string
+	NextBatch   map[string]string
+	Rooms       map[string]*Room
+	AccountData map[string]map[string]*Event // room ID ("" for global) to event type to event
+	Presences   map[string]*Presence
+	mutex       sync.RWMutex // protects the maps
 }
 
 // SaveFilterID to memory.
 func (s *InMemoryStore) SaveFilterID(userID, filterID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.Filters[userID] = filterID
 }
 
 // LoadFilterID from memory.
 func (s *InMemoryStore) LoadFilterID(userID string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.Filters[userID]
 }
 
 // SaveNextBatch to memory.
 func (s *InMemoryStore) SaveNextBatch(userID, nextBatchToken string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.NextBatch[userID] = nextBatchToken
 }
 
 // LoadNextBatch from memory.
 func (s *InMemoryStore) LoadNextBatch(userID string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.NextBatch[userID]
 }
 
 // SaveRoom to memory.
 func (s *InMemoryStore) SaveRoom(room *Room) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.Rooms[room.ID] = room
 }
 
 // LoadRoom from memory.
 func (s *InMemoryStore) LoadRoom(roomID string) *Room {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.Rooms[roomID]
 }
 
+// SaveAccountData to memory.
+func (s *InMemoryStore) SaveAccountData(roomID string, event *Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.AccountData[roomID] == nil {
+		s.AccountData[roomID] = make(map[string]*Event)
+	}
+	s.AccountData[roomID][event.Type] = event.copy()
+}
+
+// LoadAccountData from memory.
+func (s *InMemoryStore) LoadAccountData(roomID, eventType string) *Event {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.AccountData[roomID][eventType].copy()
+}
+
+// SavePresence to memory.
+func (s *InMemoryStore) SavePresence(presence *Presence) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Presences[presence.UserID] = copyPresence(presence)
+}
+
+// LoadPresence from memory.
+func (s *InMemoryStore) LoadPresence(userID string) *Presence {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return copyPresence(s.Presences[userID])
+}
+
+// LoadPresences from memory.
+func (s *InMemoryStore) LoadPresences() map[string]*Presence {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return copyPresences(s.Presences)
+}
+
+func copyPresence(presence *Presence) *Presence {
+	if presence == nil {
+		return nil
+	}
+	p := *presence
+	return &p
+}
+
+func copyPresences(presences map[string]*Presence) map[string]*Presence {
+	c := make(map[string]*Presence, len(presences))
+	for userID, presence := range presences {
+		c[userID] = copyPresence(presence)
+	}
+	return c
+}
+
 // NewInMemoryStore constructs a new InMemoryStore.
 func NewInMemoryStore() *InMemoryStore {
 	return &InMemoryStore{
-		Filters:   make(map[string]string),
-		NextBatch: make(map[string]string),
-		Rooms:     make(map[string]*Room),
+		Filters:     make(map[string]string),
+		NextBatch:   make(map[string]string),
+		Rooms:       make(map[string]*Room),
+		AccountData: make(map[string]map[string]*Event),
+		Presences:   make(map[string]*Presence),
 	}
 }
@@ -0,0 +1,157 @@
+package sdnclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testSyncResponse returns a sync response in which user i joins !room:test and sends a message.
+func testSyncResponse(t *testing.T, i int) *RespSync {
+	t.Helper()
+	data := fmt.Sprintf(`{
+		"next_batch": "s%[1]d",
+		"account_data": {"events": [{"type": "org.example.test", "content": {"n": %[1]d}}]},
+		"presence": {"events": [{"type": "m.presence", "sender": "@user%[1]d:test", "content": {"presence": "online"}}]},
+		"rooms": {"join": {"!room:test": {
+			"state": {"events": [
+				{"type": "m.room.name", "state_key": "", "sender": "@user0:test", "event_id": "$name%[1]d", "content": {"name": "Room %[1]d"}}
+			]},
+			"timeline": {"events": [
+				{"type": "m.room.member", "state_key": "@user%[1]d:test", "sender": "@user%[1]d:test", "event_id": "$join%[1]d", "content": {"membership": "join", "displayname": "User %[1]d"}},
+				{"type": "m.room.message", "sender": "@user%[1]d:test", "event_id": "$msg%[1]d", "content": {"msgtype": "m.text", "body": "hello"}}
+			]},
+			"ephemeral": {"events": [
+				{"type": "m.receipt", "content": {"$msg%[1]d": {"m.read": {"@user%[1]d:test": {"ts": 1}}}}}
+			]}
+		}}}
+	}`, i)
+	var res RespSync
+	if err := json.Unmarshal([]byte(data), &res); err != nil {
+		t.Fatal(err)
+	}
+	return &res
+}
+
+// TestConcurrentSync processes sync responses while listeners are registered and the rooms are read from the
+// store, to be run with -race.
+func TestConcurrentSync(t *testing.T) {
+	const responses = 20
+	stores := []struct {
+		name     string
+		newStore func(t *testing.T) Storer
+	}{
+		{"InMemoryStore", func(t *testing.T) Storer { return NewInMemoryStore() }},
+		{"FileStore", func(t *testing.T) Storer {
+			store, err := NewFileStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		}},
+	}
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			store := tt.newStore(t)
+			syncer := NewDefaultSyncer("@bot:test", store)
+			var messages int32
+			syncer.OnEventType("m.room.message", func(*Event) { atomic.AddInt32(&messages, 1) })
+
+			// The other goroutines keep going until all responses have been processed.
+			done := make(chan struct{})
+			running := func() bool {
+				select {
+				case <-done:
+					return false
+				default:
+					return true
+				}
+			}
+			var wg sync.WaitGroup
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				defer close(done)
+				for i := 0; i < responses; i++ {
+					if err := syncer.ProcessResponse(testSyncResponse(t, i), fmt.Sprintf("s%d", i-1)); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 1000 && running(); i++ {
+					syncer.OnEventType("m.room.member", func(*Event) {})
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for running() {
+					if room := store.LoadRoom("!room:test"); room != nil {
+						room.Name()
+						room.Members("join")
+						room.DisplayName("@bot:test")
+						room.GetStateEvent("m.room.member", "@user0:test")
+						room.PowerLevels()
+						room.GetReceipt("@user0:test", "m.read")
+						room.ReadBy("$msg0")
+						if _, err := json.Marshal(room); err != nil {
+							t.Error(err)
+						}
+					}
+					store.(PresenceStorer).LoadPresences()
+					store.(AccountDataStorer).LoadAccountData("", "org.example.test")
+				}
+			}()
+			wg.Wait()
+
+			if messages != responses {
+				t.Errorf("got %d messages, want %d", messages, responses)
+			}
+			room := store.LoadRoom("!room:test")
+			if got := len(room.Members("join")); got != responses {
+				t.Errorf("got %d members, want %d", got, responses)
+			}
+			if got, want := room.Name(), fmt.Sprintf("Room %d", responses-1); got != want {
+				t.Errorf("got name %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncer := NewDefaultSyncer("@bot:test", store)
+	if err := syncer.ProcessResponse(testSyncResponse(t, 1), "s0"); err != nil {
+		t.Fatal(err)
+	}
+	store.SaveNextBatch("@bot:test", "s1")
+	store.SaveFilterID("@bot:test", "filter")
+
+	reloaded, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.LoadNextBatch("@bot:test"); got != "s1" {
+		t.Errorf("got next batch %q, want s1", got)
+	}
+	if got := reloaded.LoadFilterID("@bot:test"); got != "filter" {
+		t.Errorf("got filter ID %q, want filter", got)
+	}
+	room := reloaded.LoadRoom("!room:test")
+	if room == nil {
+		t.Fatal("room wasn't reloaded")
+	}
+	if got := room.GetMembershipState("@user1:test"); got != "join" {
+		t.Errorf("got membership %q, want join", got)
+	}
+	if event := reloaded.LoadAccountData("", "org.example.test"); event == nil {
+		t.Error("account data wasn't reloaded")
+	}
+}
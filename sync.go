@@ -1,10 +1,14 @@
 package sdnclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"runtime/debug"
+	"sync"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // Syncer represents an interface that must be satisfied in order to do /sync requests on a client.
@@ -18,63 +22,170 @@ type Syncer interface {
 	GetFilterJSON(userID string) json.RawMessage
 }
 
+// ContextSyncer is an optional interface of a Syncer whose ProcessResponse makes requests. Sync calls
+// ProcessResponseWithContext instead, with a context which is cancelled when syncing is stopped.
+type ContextSyncer interface {
+	ProcessResponseWithContext(ctx context.Context, resp *RespSync, since string) error
+}
+
 // DefaultSyncer is the default syncing implementation. You can either write your own syncer, or selectively
 // replace parts of this default syncer (e.g. the ProcessResponse method). The default syncer uses the observer
 // pattern to notify callers about incoming events. See DefaultSyncer.OnEventType for more information.
 type DefaultSyncer struct {
-	UserID    string
-	Store     Storer
-	listeners map[string][]OnEventListener // event type to listeners array
+	UserID string
+	Store  Storer
+	// FillGaps makes the syncer back-paginate with Client when the timeline of a joined room is limited, and
+	// dispatch the events missed between the previous and the current sync before the new ones.
+	FillGaps bool
+	// GapFillLimit is the maximum number of missed events fetched per room and sync.
+	GapFillLimit int
+	// Client is used to fill gaps and tells whether an invalid access token can be recovered from by logging
+	// in again. NewClient sets it to the client owning the syncer.
+	Client *Client
+	// OwnJoin controls what happens to events delivered together with the bot's own join to a room.
+	OwnJoin OwnJoinMode
+	// InitialSync controls which events of the first sync (without a since token) are dispatched.
+	InitialSync InitialSyncMode
+	// InitialSyncMaxAge is the maximum age of the timeline events dispatched with InitialSyncRecent.
+	InitialSyncMaxAge time.Duration
+
+	lastEventIDs         map[string]string            // room ID to the last timeline event seen, only used by ProcessResponse
+	listeners            map[string][]OnEventListener // event type to listeners array
+	redactionListeners   []OnRedactionListener
+	accountDataListeners map[string][]OnEventListener    // account data type to listeners array
+	toDeviceListeners    map[string][]OnToDeviceListener // to-device event type to listeners array
+	listenersMutex       sync.RWMutex                    // protects all listeners
 }
 
+// OwnJoinMode tells DefaultSyncer how to treat a joined room whose timeline contains the bot's own join.
+// The server sends the recent history of a room on join, which the bot may already have processed
+// before leaving and re-joining it.
+type OwnJoinMode int
+
+const (
+	// OwnJoinProcessAfter suppresses the events at or before the bot's latest join and dispatches those after it.
+	// Suppressed state events are still applied to the room state.
+	OwnJoinProcessAfter OwnJoinMode = iota
+	// OwnJoinSkipRoom dispatches no event of the room, including any pending invite for it, from that sync
+	// response. The room state is still updated.
+	OwnJoinSkipRoom
+)
+
+// InitialSyncMode tells DefaultSyncer which events of the first sync to dispatch. The first sync returns the
+// recent history of every room, which a bot without persisted state may already have processed.
+// The room state and receipts are updated from the first sync in every mode, only dispatching differs.
+type InitialSyncMode int
+
+const (
+	// InitialSyncSkip dispatches no event of the first sync.
+	InitialSyncSkip InitialSyncMode = iota
+	// InitialSyncInvitesAndState dispatches pending invites and state events, but no other timeline events.
+	InitialSyncInvitesAndState
+	// InitialSyncRecent is like InitialSyncInvitesAndState, but also dispatches timeline events younger than
+	// InitialSyncMaxAge and ephemeral events.
+	InitialSyncRecent
+	// InitialSyncAll dispatches every event of the first sync.
+	InitialSyncAll
+)
+
 // OnEventListener can be used with DefaultSyncer.OnEventType to be informed of incoming events.
 type OnEventListener func(*Event)
 
+// OnToDeviceListener can be used with DefaultSyncer.OnToDeviceEventType to be informed of to-device events.
+// The sender is event.Sender, senderDevice is the sending device if the event tells it, or "".
+type OnToDeviceListener func(event *Event, senderDevice string)
+
+// OnRedactionListener can be used with DefaultSyncer.OnRedaction to be informed of redactions.
+type OnRedactionListener func(redaction *Event, original *Event)
+
 // NewDefaultSyncer returns an instantiated DefaultSyncer
 func NewDefaultSyncer(userID string, store Storer) *DefaultSyncer {
 	return &DefaultSyncer{
-		UserID:    userID,
-		Store:     store,
-		listeners: make(map[string][]OnEventListener),
+		UserID:               userID,
+		Store:                store,
+		GapFillLimit:         1000,
+		lastEventIDs:         make(map[string]string),
+		listeners:            make(map[string][]OnEventListener),
+		accountDataListeners: make(map[string][]OnEventListener),
+		toDeviceListeners:    make(map[string][]OnToDeviceListener),
 	}
 }
 
 // ProcessResponse processes the /sync response in a way suitable for bots. "Suitable for bots" means a stream of
 // unrepeating events. Returns a fatal error if a listener panics.
-func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error) {
-	if !s.shouldProcessResponse(res, since) {
-		return
-	}
+func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) error {
+	return s.ProcessResponseWithContext(context.Background(), res, since)
+}
 
+// ProcessResponseWithContext is like ProcessResponse but with a context, which aborts filling gaps.
+func (s *DefaultSyncer) ProcessResponseWithContext(ctx context.Context, res *RespSync, since string) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err = fmt.Errorf("ProcessResponse panicked! userID=%s since=%s panic=%s\n%s", s.UserID, since, r, debug.Stack())
 		}
 	}()
 
+	// Account data and presence are only sent on the first sync and when they change, so they are always stored.
+	notify := since != "" || s.InitialSync != InitialSyncSkip
+	s.processAccountData(res, notify)
+	s.processPresence(res, notify)
+	// To-device events are deleted by the server once delivered, so they are never skipped.
+	s.processToDevice(res)
+
+	// The room state, receipts and last event IDs are always updated. The initial sync mode and the own join
+	// mode only decide which events are dispatched to listeners.
+	initial := since == ""
+	suppressed, skippedRooms := s.suppressedEvents(res, since)
+
 	for roomID, roomData := range res.Rooms.Join {
 		room := s.getOrCreateRoom(roomID)
+		// Events at or before our own join are only applied to the room state.
+		skip := suppressed[roomID]
+		notifyState := !skippedRooms[roomID] && skip == 0 && (!initial || s.InitialSync != InitialSyncSkip)
 		for _, event := range roomData.State.Events {
 			event.RoomID = roomID
 			room.UpdateState(&event)
-			s.notifyListeners(&event)
+			if notifyState {
+				s.notifyListeners(&event)
+			}
 		}
-		for _, event := range roomData.Timeline.Events {
+		if s.FillGaps && roomData.Timeline.Limited && !initial && skip == 0 && !skippedRooms[roomID] {
+			for _, event := range s.fetchGap(ctx, roomID, roomData.Timeline.PrevBatch, since, roomData.Timeline.Events) {
+				event.RoomID = roomID
+				s.processTimelineEvent(room, &event, true)
+			}
+		}
+		for i, event := range roomData.Timeline.Events {
 			event.RoomID = roomID
-			s.notifyListeners(&event)
+			notify := !skippedRooms[roomID] && i >= skip && (!initial || s.dispatchInitial(&event))
+			s.processTimelineEvent(room, &event, notify)
+		}
+		if n := len(roomData.Timeline.Events); n > 0 {
+			s.lastEventIDs[roomID] = roomData.Timeline.Events[n-1].ID
 		}
+		notifyEphemeral := !skippedRooms[roomID] && (!initial || s.InitialSync >= InitialSyncRecent)
 		for _, event := range roomData.Ephemeral.Events {
 			event.RoomID = roomID
-			s.notifyListeners(&event)
+			if event.Type == "m.receipt" {
+				room.UpdateReceipts(ParseReceipts(&event))
+			}
+			if notifyEphemeral {
+				s.notifyListeners(&event)
+			}
 		}
+		s.Store.SaveRoom(room)
 	}
+	notifyOther := !initial || s.InitialSync != InitialSyncSkip
 	for roomID, roomData := range res.Rooms.Invite {
 		room := s.getOrCreateRoom(roomID)
 		for _, event := range roomData.State.Events {
 			event.RoomID = roomID
 			room.UpdateState(&event)
-			s.notifyListeners(&event)
+			if notifyOther && !skippedRooms[roomID] {
+				s.notifyListeners(&event)
+			}
 		}
+		s.Store.SaveRoom(room)
 	}
 	for roomID, roomData := range res.Rooms.Leave {
 		room := s.getOrCreateRoom(roomID)
@@ -82,16 +193,193 @@ func (s *DefaultSyncer) ProcessResponse(res *RespSync, since string) (err error)
 			if event.StateKey != nil {
 				event.RoomID = roomID
 				room.UpdateState(&event)
-				s.notifyListeners(&event)
+				if notifyOther {
+					s.notifyListeners(&event)
+				}
 			}
 		}
+		s.Store.SaveRoom(room)
 	}
 	return
 }
 
+// fetchGap back-paginates from the start of a limited timeline (prevBatch) to the previous sync (since) or the
+// last event seen in the room, and returns the missed events in chronological order. Errors are logged, and
+// whatever was fetched so far is returned.
+func (s *DefaultSyncer) fetchGap(ctx context.Context, roomID, prevBatch, since string, timeline []Event) []Event {
+	if s.Client == nil || prevBatch == "" {
+		return nil
+	}
+	lastEventID := s.lastEventIDs[roomID]
+	inTimeline := make(map[string]bool, len(timeline))
+	for _, event := range timeline {
+		inTimeline[event.ID] = true
+	}
+
+	var events []Event
+	token := prevBatch
+fetch:
+	for len(events) < s.GapFillLimit {
+		resp, err := s.Client.MessagesWithContext(ctx, roomID, token, since, 'b', 100, nil)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("failed to fill gap in %s: %v", roomID, err)
+			}
+			break
+		}
+		for _, event := range resp.Chunk {
+			if event.ID == lastEventID || len(events) == s.GapFillLimit {
+				break fetch
+			}
+			if !inTimeline[event.ID] {
+				events = append(events, event)
+			}
+		}
+		if len(resp.Chunk) == 0 || resp.End == "" || resp.End == token {
+			break
+		}
+		token = resp.End
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events
+}
+
+// processAccountData saves the global and per-room account data of a sync response to the store, if it is
+// an AccountDataStorer, and, if notify is set, notifies account data listeners.
+func (s *DefaultSyncer) processAccountData(res *RespSync, notify bool) {
+	store, _ := s.Store.(AccountDataStorer)
+	process := func(roomID string, events []Event) {
+		for _, event := range events {
+			event.RoomID = roomID
+			if store != nil {
+				store.SaveAccountData(roomID, &event)
+			}
+			if notify {
+				s.notifyAccountDataListeners(&event)
+			}
+		}
+	}
+	process("", res.AccountData.Events)
+	for roomID, roomData := range res.Rooms.Join {
+		process(roomID, roomData.AccountData.Events)
+	}
+	for roomID, roomData := range res.Rooms.Leave {
+		process(roomID, roomData.AccountData.Events)
+	}
+}
+
+// processPresence saves the m.presence events of a sync response to the store, if it is a PresenceStorer,
+// and, if notify is set, notifies listeners.
+func (s *DefaultSyncer) processPresence(res *RespSync, notify bool) {
+	store, _ := s.Store.(PresenceStorer)
+	for _, event := range res.Presence.Events {
+		if presence := ParsePresence(&event); presence != nil && store != nil {
+			store.SavePresence(presence)
+		}
+		if notify {
+			s.notifyListeners(&event)
+		}
+	}
+}
+
+// processToDevice notifies to-device listeners of the to-device events of a sync response.
+func (s *DefaultSyncer) processToDevice(res *RespSync) {
+	for _, event := range res.ToDevice.Events {
+		s.listenersMutex.RLock()
+		listeners := s.toDeviceListeners[event.Type]
+		s.listenersMutex.RUnlock()
+		senderDevice := event.SenderDevice()
+		for _, fn := range listeners {
+			fn(&event, senderDevice)
+		}
+	}
+}
+
+// OnToDeviceEventType allows callers to be notified of to-device events of the given type. To-device events
+// are dispatched on every sync, including the first one.
+func (s *DefaultSyncer) OnToDeviceEventType(eventType string, callback OnToDeviceListener) {
+	s.listenersMutex.Lock()
+	defer s.listenersMutex.Unlock()
+	s.toDeviceListeners[eventType] = append(s.toDeviceListeners[eventType], callback)
+}
+
+// OnAccountDataType allows callers to be notified when global or per-room account data of the given type
+// changes. Per-room account data events have their RoomID set.
+func (s *DefaultSyncer) OnAccountDataType(eventType string, callback OnEventListener) {
+	s.listenersMutex.Lock()
+	defer s.listenersMutex.Unlock()
+	s.accountDataListeners[eventType] = append(s.accountDataListeners[eventType], callback)
+}
+
+func (s *DefaultSyncer) notifyAccountDataListeners(event *Event) {
+	s.listenersMutex.RLock()
+	listeners := s.accountDataListeners[event.Type]
+	s.listenersMutex.RUnlock()
+	for _, fn := range listeners {
+		fn(event)
+	}
+}
+
+// dispatchInitial returns true if a timeline event of the first sync should be dispatched.
+func (s *DefaultSyncer) dispatchInitial(event *Event) bool {
+	switch s.InitialSync {
+	case InitialSyncInvitesAndState:
+		return event.StateKey != nil
+	case InitialSyncRecent:
+		age := time.Since(time.UnixMilli(event.Timestamp))
+		return event.StateKey != nil || age <= s.InitialSyncMaxAge
+	case InitialSyncAll:
+		return true
+	}
+	return false
+}
+
+// processTimelineEvent records the position of a timeline event of a joined room, applies it to the room state
+// and, if notify is set, notifies listeners.
+func (s *DefaultSyncer) processTimelineEvent(room *Room, event *Event, notify bool) {
+	room.AddTimelineEvent(event)
+	if event.StateKey != nil {
+		room.UpdateState(event)
+	}
+	var original *Event
+	if event.Type == "m.room.redaction" {
+		original = room.Redact(event)
+	}
+	if !notify {
+		return
+	}
+	if event.Type == "m.room.redaction" {
+		s.notifyRedactionListeners(event, original)
+	}
+	s.notifyListeners(event)
+}
+
+// OnRedaction allows callers to be notified of redactions. The listener receives the m.room.redaction event
+// and the redacted event as it was before the redaction, or nil if it isn't known. Only state events are
+// known, since the store keeps no other events.
+func (s *DefaultSyncer) OnRedaction(callback OnRedactionListener) {
+	s.listenersMutex.Lock()
+	defer s.listenersMutex.Unlock()
+	s.redactionListeners = append(s.redactionListeners, callback)
+}
+
+func (s *DefaultSyncer) notifyRedactionListeners(redaction, original *Event) {
+	s.listenersMutex.RLock()
+	listeners := s.redactionListeners
+	s.listenersMutex.RUnlock()
+	for _, fn := range listeners {
+		fn(redaction, original)
+	}
+}
+
 // OnEventType allows callers to be notified when there are new events for the given event type.
-// There are no duplicate checks.
+// There are no duplicate checks. It is safe to register listeners while syncing.
 func (s *DefaultSyncer) OnEventType(eventType string, callback OnEventListener) {
+	s.listenersMutex.Lock()
+	defer s.listenersMutex.Unlock()
 	_, exists := s.listeners[eventType]
 	if !exists {
 		s.listeners[eventType] = []OnEventListener{}
@@ -99,41 +387,60 @@ func (s *DefaultSyncer) OnEventType(eventType string, callback OnEventListener)
 	s.listeners[eventType] = append(s.listeners[eventType], callback)
 }
 
-// shouldProcessResponse returns true if the response should be processed. May modify the response to remove
-// stuff that shouldn't be processed.
-func (s *DefaultSyncer) shouldProcessResponse(resp *RespSync, since string) bool {
+// suppressedEvents returns, for joined rooms in which the bot has just joined, the number of leading timeline
+// events which must not be dispatched, and with OwnJoinSkipRoom the rooms of which nothing must be dispatched.
+//
+// /sync will return the most recent messages for a room as soon as you /join it. We do NOT want to
+// process those events in that particular room because they may have already been processed (if you
+// toggle the bot in/out of the room).
+//
+// Work around this by inspecting each room's timeline and seeing if an m.room.member event for us
+// exists and is "join". Then either suppress the events up to the latest such join, or, with
+// OwnJoinSkipRoom, suppress the whole room.
+func (s *DefaultSyncer) suppressedEvents(resp *RespSync, since string) (map[string]int, map[string]bool) {
+	suppressed := make(map[string]int)
+	skippedRooms := make(map[string]bool)
 	if since == "" {
-		return false
-	}
-	// This is a horrible hack because /sync will return the most recent messages for a room
-	// as soon as you /join it. We do NOT want to process those events in that particular room
-	// because they may have already been processed (if you toggle the bot in/out of the room).
-	//
-	// Work around this by inspecting each room's timeline and seeing if an m.room.member event for us
-	// exists and is "join" and then discard processing that room entirely if so.
-	// TODO: We probably want to process messages from after the last join event in the timeline.
+		// Our own joins are part of the history the initial sync mode decides about.
+		return suppressed, skippedRooms
+	}
 	for roomID, roomData := range resp.Rooms.Join {
-		for i := len(roomData.Timeline.Events) - 1; i >= 0; i-- {
-			e := roomData.Timeline.Events[i]
-			if e.Type == "m.room.member" && e.StateKey != nil && *e.StateKey == s.UserID {
-				m := e.Content["membership"]
-				mship, ok := m.(string)
-				if !ok {
-					continue
-				}
-				if mship == "join" {
-					_, ok := resp.Rooms.Join[roomID]
-					if !ok {
-						continue
-					}
-					delete(resp.Rooms.Join, roomID)   // don't re-process messages
-					delete(resp.Rooms.Invite, roomID) // don't re-process invites
-					break
-				}
+		joinIndex := s.latestOwnJoin(roomData.Timeline.Events)
+		if joinIndex < 0 {
+			continue
+		}
+		if s.OwnJoin == OwnJoinSkipRoom {
+			skippedRooms[roomID] = true // don't re-process messages or invites
+			continue
+		}
+		suppressed[roomID] = joinIndex + 1
+	}
+	return suppressed, skippedRooms
+}
+
+// latestOwnJoin returns the index of the latest m.room.member join event of the bot in events, or -1.
+// Profile changes, i.e. join events whose previous membership was already join, are not joins.
+func (s *DefaultSyncer) latestOwnJoin(events []Event) int {
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		if e.Type == "m.room.member" && e.StateKey != nil && *e.StateKey == s.UserID {
+			if mship, ok := e.Content["membership"].(string); ok && mship == "join" && prevMembership(&e) != "join" {
+				return i
 			}
 		}
 	}
-	return true
+	return -1
+}
+
+// prevMembership returns the membership before an m.room.member event, from its prev_content, which servers
+// send either at the top level or in unsigned, or "" if it isn't known.
+func prevMembership(event *Event) string {
+	prevContent := event.PrevContent
+	if prevContent == nil {
+		prevContent, _ = event.Unsigned["prev_content"].(map[string]interface{})
+	}
+	membership, _ := prevContent["membership"].(string)
+	return membership
 }
 
 // getOrCreateRoom must only be called by the Sync() goroutine which calls ProcessResponse()
@@ -147,17 +454,21 @@ func (s *DefaultSyncer) getOrCreateRoom(roomID string) *Room {
 }
 
 func (s *DefaultSyncer) notifyListeners(event *Event) {
-	listeners, exists := s.listeners[event.Type]
-	if !exists {
-		return
-	}
+	s.listenersMutex.RLock()
+	listeners := s.listeners[event.Type]
+	s.listenersMutex.RUnlock()
 	for _, fn := range listeners {
 		fn(event)
 	}
 }
 
-// OnFailedSync always returns a 10 second wait period between failed /syncs, never a fatal error.
+// OnFailedSync returns a 10 second wait period between failed /syncs. The only fatal error is an invalid
+// access token when the client can't log in again, i.e. Client is nil, has no Signer or has AutoRelogin
+// disabled. Otherwise the re-login may have failed for a passing reason and the next /sync tries again.
 func (s *DefaultSyncer) OnFailedSync(res *RespSync, err error) (time.Duration, error) {
+	if IsUnknownToken(err) && (s.Client == nil || !s.Client.AutoRelogin || s.Client.Signer == nil) {
+		return 0, err
+	}
 	return 10 * time.Second, nil
 }
 
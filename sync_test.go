@@ -0,0 +1,173 @@
+package sdnclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testInitialSyncResponse returns a first sync response with a joined room, with state, old and recent
+// timeline events and ephemeral events, and a pending invite.
+func testInitialSyncResponse(t *testing.T) *RespSync {
+	t.Helper()
+	data := fmt.Sprintf(`{
+		"next_batch": "s1",
+		"rooms": {
+			"join": {"!room:test": {
+				"state": {"events": [
+					{"type": "m.room.create", "state_key": "", "sender": "@alice:test", "event_id": "$create", "content": {"creator": "@alice:test"}},
+					{"type": "m.room.power_levels", "state_key": "", "sender": "@alice:test", "event_id": "$power", "content": {"users": {"@alice:test": 100, "@bot:test": 50}}},
+					{"type": "m.room.member", "state_key": "@alice:test", "sender": "@alice:test", "event_id": "$alice", "content": {"membership": "join", "displayname": "Alice"}},
+					{"type": "m.room.member", "state_key": "@bot:test", "sender": "@bot:test", "event_id": "$bot", "content": {"membership": "join"}}
+				]},
+				"timeline": {"events": [
+					{"type": "m.room.message", "sender": "@alice:test", "event_id": "$old", "origin_server_ts": 1000, "content": {"msgtype": "m.text", "body": "old"}},
+					{"type": "m.room.member", "state_key": "@bob:test", "sender": "@bob:test", "event_id": "$bob", "origin_server_ts": 2000, "content": {"membership": "join", "displayname": "Bob"}},
+					{"type": "m.room.message", "sender": "@bob:test", "event_id": "$recent", "origin_server_ts": %d, "content": {"msgtype": "m.text", "body": "recent"}}
+				]},
+				"ephemeral": {"events": [
+					{"type": "m.receipt", "content": {"$recent": {"m.read": {"@alice:test": {"ts": 1}}}}},
+					{"type": "m.typing", "content": {"user_ids": ["@bob:test"]}}
+				]}
+			}},
+			"invite": {"!invite:test": {
+				"invite_state": {"events": [
+					{"type": "m.room.member", "state_key": "@bot:test", "sender": "@carol:test", "event_id": "$invite", "content": {"membership": "invite"}}
+				]}
+			}}
+		}
+	}`, time.Now().UnixMilli())
+	var res RespSync
+	if err := json.Unmarshal([]byte(data), &res); err != nil {
+		t.Fatal(err)
+	}
+	return &res
+}
+
+// recordEvents registers listeners for the given event types and returns the dispatched events, identified
+// by their ID or, for ephemeral events, by their type.
+func recordEvents(syncer *DefaultSyncer, eventTypes ...string) *[]string {
+	var dispatched []string
+	for _, eventType := range eventTypes {
+		syncer.OnEventType(eventType, func(event *Event) {
+			if event.ID != "" {
+				dispatched = append(dispatched, event.ID)
+			} else {
+				dispatched = append(dispatched, event.Type)
+			}
+		})
+	}
+	return &dispatched
+}
+
+func TestProcessResponseInitialSync(t *testing.T) {
+	state := []string{"$create", "$power", "$alice", "$bot", "$bob", "$invite"}
+	tests := []struct {
+		name string
+		mode InitialSyncMode
+		want []string
+	}{
+		{"skip", InitialSyncSkip, nil},
+		{"invites and state", InitialSyncInvitesAndState, state},
+		{"recent", InitialSyncRecent, append([]string{"$recent", "m.receipt", "m.typing"}, state...)},
+		{"all", InitialSyncAll, append([]string{"$old", "$recent", "m.receipt", "m.typing"}, state...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewInMemoryStore()
+			syncer := NewDefaultSyncer("@bot:test", store)
+			syncer.InitialSync = tt.mode
+			syncer.InitialSyncMaxAge = time.Hour
+			dispatched := recordEvents(syncer, "m.room.create", "m.room.power_levels", "m.room.member",
+				"m.room.message", "m.receipt", "m.typing")
+
+			if err := syncer.ProcessResponse(testInitialSyncResponse(t), ""); err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(*dispatched)
+			sort.Strings(tt.want)
+			if !reflect.DeepEqual(*dispatched, tt.want) {
+				t.Errorf("dispatched %v, want %v", *dispatched, tt.want)
+			}
+
+			// Whatever was dispatched, the room state and receipts are complete.
+			room := store.LoadRoom("!room:test")
+			if room == nil {
+				t.Fatal("joined room wasn't stored")
+			}
+			if got := room.DisplayName("@bot:test"); got != "Alice and Bob" {
+				t.Errorf("got display name %q, want Alice and Bob", got)
+			}
+			if !room.CanKick("@bot:test", "@bob:test") || room.CanKick("@bot:test", "@alice:test") {
+				t.Error("power levels weren't applied")
+			}
+			if receipt, ok := room.GetReceipt("@alice:test", "m.read"); !ok || receipt.EventID != "$recent" {
+				t.Errorf("got receipt %+v, %t, want the receipt at $recent", receipt, ok)
+			}
+			if got := syncer.lastEventIDs["!room:test"]; got != "$recent" {
+				t.Errorf("got last event ID %q, want $recent", got)
+			}
+			if room := store.LoadRoom("!invite:test"); room == nil || room.GetMembershipState("@bot:test") != "invite" {
+				t.Error("invite wasn't stored")
+			}
+		})
+	}
+}
+
+func TestProcessResponseOwnJoin(t *testing.T) {
+	message := func(id string) string {
+		return `{"type": "m.room.message", "sender": "@alice:test", "event_id": "` + id + `", "content": {"msgtype": "m.text", "body": "hi"}}`
+	}
+	join := `{"type": "m.room.member", "state_key": "@bot:test", "sender": "@bot:test", "event_id": "$join",
+		"content": {"membership": "join"}, "unsigned": {"prev_content": {"membership": "invite"}}}`
+	rejoin := `{"type": "m.room.member", "state_key": "@bot:test", "sender": "@bot:test", "event_id": "$join",
+		"content": {"membership": "join"}}`
+	profile := `{"type": "m.room.member", "state_key": "@bot:test", "sender": "@bot:test", "event_id": "$profile",
+		"content": {"membership": "join", "displayname": "Bot"}, "unsigned": {"prev_content": {"membership": "join"}}}`
+	profileTopLevel := `{"type": "m.room.member", "state_key": "@bot:test", "sender": "@bot:test", "event_id": "$profile",
+		"content": {"membership": "join", "displayname": "Bot"}, "prev_content": {"membership": "join"}}`
+
+	tests := []struct {
+		name     string
+		mode     OwnJoinMode
+		timeline []string
+		want     []string
+	}{
+		{"join", OwnJoinProcessAfter, []string{message("$a"), join, message("$b")}, []string{"$b"}},
+		{"join without prev_content", OwnJoinProcessAfter, []string{message("$a"), rejoin, message("$b")}, []string{"$b"}},
+		{"profile change", OwnJoinProcessAfter, []string{message("$a"), profile, message("$b")}, []string{"$a", "$profile", "$b"}},
+		{"profile change with top-level prev_content", OwnJoinProcessAfter, []string{message("$a"), profileTopLevel, message("$b")}, []string{"$a", "$profile", "$b"}},
+		{"join then profile change", OwnJoinProcessAfter, []string{message("$a"), join, message("$b"), profile, message("$c")}, []string{"$b", "$profile", "$c"}},
+		{"join skipping the room", OwnJoinSkipRoom, []string{message("$a"), join, message("$b")}, nil},
+		{"profile change skipping the room", OwnJoinSkipRoom, []string{message("$a"), profile}, []string{"$a", "$profile"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := `{"next_batch": "s2", "rooms": {"join": {"!room:test": {"timeline": {"events": [` +
+				strings.Join(tt.timeline, ",") + `]}}}}}`
+			var res RespSync
+			if err := json.Unmarshal([]byte(data), &res); err != nil {
+				t.Fatal(err)
+			}
+			store := NewInMemoryStore()
+			syncer := NewDefaultSyncer("@bot:test", store)
+			syncer.OwnJoin = tt.mode
+			dispatched := recordEvents(syncer, "m.room.member", "m.room.message")
+
+			if err := syncer.ProcessResponse(&res, "s1"); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*dispatched, tt.want) {
+				t.Errorf("dispatched %v, want %v", *dispatched, tt.want)
+			}
+			// Suppressed events are still applied to the room state.
+			if got := store.LoadRoom("!room:test").GetMembershipState("@bot:test"); got != "join" {
+				t.Errorf("got membership %q, want join", got)
+			}
+		})
+	}
+}
@@ -1,37 +1,267 @@
 package main
 
 import (
-	"bytes"
 	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
-	ethereumcrypto "github.com/ethereum/go-ethereum/crypto"
-	"math/rand"
+	"math/big"
+	"os"
+	"path/filepath"
 	"strings"
-	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	ethereumcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	sdnclient "github.com/sending-network/sendingnetwork-bot"
+	"github.com/tyler-smith/go-bip39"
+	"golang.org/x/term"
 )
 
-func generateWalletAccount() (string, *ecdsa.PrivateKey, error) {
-	rand.Seed(time.Now().UnixNano())
-	entropyBase := "0000000000000000000000000000000"
-	for i := 0; i < 9; i++ {
-		entropyBase = fmt.Sprintf("%v%v", entropyBase, rand.Intn(10))
+var (
+	useMnemonic   = flag.Bool("mnemonic", false, "derive the key from a new BIP-39 mnemonic, which is printed")
+	mnemonicBits  = flag.Int("mnemonic-bits", 128, "entropy of the new mnemonic in bits: 128 (12 words) to 256 (24 words)")
+	mnemonicEnv   = flag.String("mnemonic-env", "", "derive the key from the existing mnemonic in this environment variable")
+	derivation    = flag.String("path", accounts.DefaultBaseDerivationPath.String(), "BIP-44 derivation path used with a mnemonic")
+	keystorePath  = flag.String("keystore", "", "write the key to this encrypted V3 keystore file instead of printing it")
+	passphraseEnv = flag.String("passphrase-env", "", "read the keystore passphrase from this environment variable instead of prompting")
+	configPath    = flag.String("config", "", "write a ready-to-use configuration file to this path")
+	endpoint      = flag.String("endpoint", "", "server endpoint written to the configuration file")
+	force         = flag.Bool("force", false, "overwrite an existing keystore or configuration file")
+)
+
+// generateWalletAccount returns a new private key and, when a mnemonic is used, the mnemonic it was derived from.
+func generateWalletAccount() (*ecdsa.PrivateKey, string, error) {
+	mnemonic := ""
+	switch {
+	case *mnemonicEnv != "":
+		mnemonic = os.Getenv(*mnemonicEnv)
+		if !bip39.IsMnemonicValid(mnemonic) {
+			return nil, "", fmt.Errorf("invalid mnemonic in %s", *mnemonicEnv)
+		}
+	case *useMnemonic:
+		entropy, err := bip39.NewEntropy(*mnemonicBits)
+		if err != nil {
+			return nil, "", err
+		}
+		mnemonic, err = bip39.NewMnemonic(entropy)
+		if err != nil {
+			return nil, "", err
+		}
+	default:
+		privateKey, err := ethereumcrypto.GenerateKey() // reads from crypto/rand
+		return privateKey, "", err
 	}
-	entropy := []byte(entropyBase)
-	reader := bytes.NewReader(entropy)
-	privateKey, err := ecdsa.GenerateKey(ethereumcrypto.S256(), reader)
+
+	path, err := accounts.ParseDerivationPath(*derivation)
 	if err != nil {
-		return "", nil, err
+		return nil, "", err
 	}
-	address := strings.ToLower(ethereumcrypto.PubkeyToAddress(*privateKey.Public().(*ecdsa.PublicKey)).String())
-	return address, privateKey, nil
+	privateKey, err := deriveKey(bip39.NewSeed(mnemonic, ""), path)
+	return privateKey, mnemonic, err
 }
 
-func main() {
-	address, privateKey, err := generateWalletAccount()
+// deriveKey derives the BIP-32 private key at path from the master seed.
+func deriveKey(seed []byte, path accounts.DerivationPath) (*ecdsa.PrivateKey, error) {
+	mac := hmac.New(sha512.New, []byte("Bitcoin seed"))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+	key, chainCode := sum[:32], sum[32:]
+
+	n := ethereumcrypto.S256().Params().N
+	for _, index := range path {
+		var data []byte
+		if index >= 0x80000000 { // hardened
+			data = append([]byte{0}, key...)
+		} else {
+			parent, err := ethereumcrypto.ToECDSA(key)
+			if err != nil {
+				return nil, err
+			}
+			data = ethereumcrypto.CompressPubkey(&parent.PublicKey)
+		}
+		data = binary.BigEndian.AppendUint32(data, index)
+
+		mac := hmac.New(sha512.New, chainCode)
+		mac.Write(data)
+		sum := mac.Sum(nil)
+		il := new(big.Int).SetBytes(sum[:32])
+		if il.Cmp(n) >= 0 {
+			return nil, errors.New("invalid child key, try another derivation index")
+		}
+		child := il.Add(il, new(big.Int).SetBytes(key))
+		child.Mod(child, n)
+		if child.Sign() == 0 {
+			return nil, errors.New("invalid child key, try another derivation index")
+		}
+		key = ethereumcrypto.FromECDSA(&ecdsa.PrivateKey{D: child, PublicKey: ecdsa.PublicKey{Curve: ethereumcrypto.S256()}})
+		chainCode = sum[32:]
+	}
+	return ethereumcrypto.ToECDSA(key)
+}
+
+func readPassphrase() (string, error) {
+	if *passphraseEnv != "" {
+		passphrase, ok := os.LookupEnv(*passphraseEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", *passphraseEnv)
+		}
+		return passphrase, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("stdin is not a terminal, use -passphrase-env")
+	}
+	fmt.Fprint(os.Stderr, "Keystore passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(passphrase) != string(repeated) {
+		return "", errors.New("passphrases do not match")
+	}
+	return string(passphrase), nil
+}
+
+// checkNotExists returns an error if path exists and -force isn't set, so that an existing key isn't lost.
+func checkNotExists(path string) error {
+	if path == "" || *force {
+		return nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func writeKeystore(path string, privateKey *ecdsa.PrivateKey, passphrase string) error {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+	keyJSON, err := keystore.EncryptKey(&keystore.Key{
+		Id:         id,
+		Address:    ethereumcrypto.PubkeyToAddress(privateKey.PublicKey),
+		PrivateKey: privateKey,
+	}, passphrase, keystore.StandardScryptN, keystore.StandardScryptP)
+	if err != nil {
+		return err
+	}
+	return writeFileNoLoss(path, keyJSON)
+}
+
+// writeFileNoLoss writes data to path with mode 0600 without ever leaving a partial file behind: the data is
+// written to a temporary file, which then replaces path with -force, or is linked to path otherwise, so that
+// an existing file is never overwritten.
+func writeFileNoLoss(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath) // the temporary name is never kept
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if *force {
+		err = os.Rename(tmpPath, path)
+	} else {
+		err = os.Link(tmpPath, path)
+	}
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", path)
+	}
+	if err != nil {
+		return err
+	}
+	// Make the new name durable. Not all platforms support syncing a directory, so errors are ignored.
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		_ = dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func run() error {
+	// Check before generating anything, so that a keystore isn't written when the config can't be.
+	if err := checkNotExists(*keystorePath); err != nil {
+		return err
+	}
+	if err := checkNotExists(*configPath); err != nil {
+		return err
+	}
+
+	privateKey, mnemonic, err := generateWalletAccount()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	address := strings.ToLower(ethereumcrypto.PubkeyToAddress(privateKey.PublicKey).String())
+	config := &sdnclient.Config{
+		Endpoint:      *endpoint,
+		WalletAddress: address,
 	}
+
 	fmt.Printf("WalletAddress: %s\n", address)
-	fmt.Printf("PrivateKey: %s\n", hex.EncodeToString(ethereumcrypto.FromECDSA(privateKey)))
+	if *useMnemonic {
+		fmt.Printf("Mnemonic: %s\n", mnemonic)
+		fmt.Printf("DerivationPath: %s\n", *derivation)
+	}
+	if *keystorePath != "" {
+		passphrase, err := readPassphrase()
+		if err != nil {
+			return err
+		}
+		if err := writeKeystore(*keystorePath, privateKey, passphrase); err != nil {
+			return err
+		}
+		fmt.Printf("Keystore: %s\n", *keystorePath)
+		config.KeystorePath = *keystorePath
+		config.KeystorePassphraseEnv = *passphraseEnv
+	} else {
+		config.PrivateKey = hex.EncodeToString(ethereumcrypto.FromECDSA(privateKey))
+		if *configPath == "" {
+			fmt.Printf("PrivateKey: %s\n", config.PrivateKey)
+		}
+	}
+	if *configPath != "" {
+		if err := sdnclient.SaveConfig(*configPath, config); err != nil {
+			return err
+		}
+		fmt.Printf("Config: %s\n", *configPath)
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
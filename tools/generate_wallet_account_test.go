@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	ethereumcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/tyler-smith/go-bip39"
+)
+
+func TestDeriveKey(t *testing.T) {
+	const mnemonic = "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+	tests := []struct {
+		path    string
+		address string
+	}{
+		{"m/44'/60'/0'/0/0", "0x9858EfFD232B4033E47d90003D41EC34EcaEda94"},
+		{"m/44'/60'/0'/0/1", "0x6Fac4D18c912343BF86fa7049364Dd4E424Ab9C0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			path, err := accounts.ParseDerivationPath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := deriveKey(bip39.NewSeed(mnemonic, ""), path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ethereumcrypto.PubkeyToAddress(key.PublicKey).Hex(); got != tt.address {
+				t.Errorf("got address %s, want %s", got, tt.address)
+			}
+		})
+	}
+}
+
+func TestWriteKeystoreRefusesOverwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet.json")
+	key, err := ethereumcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKeystore(path, key, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkNotExists(path); err == nil {
+		t.Error("checkNotExists accepted an existing keystore")
+	}
+
+	other, err := ethereumcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeKeystore(path, other, "secret")
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("got error %v, want already exists", err)
+	}
+	keyJSON, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := keystore.DecryptKey(keyJSON, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Address != ethereumcrypto.PubkeyToAddress(key.PublicKey) {
+		t.Error("the existing keystore was overwritten")
+	}
+	if entries, err := os.ReadDir(filepath.Dir(path)); err != nil || len(entries) != 1 {
+		t.Errorf("got %d files, %v, want only the keystore", len(entries), err)
+	}
+}
+
+func TestWriteKeystoreForce(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wallet.json")
+	if err := os.WriteFile(path, []byte("old keystore"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	*force = true
+	defer func() { *force = false }()
+
+	key, err := ethereumcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKeystore(path, key, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	keyJSON, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := keystore.DecryptKey(keyJSON, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Address != ethereumcrypto.PubkeyToAddress(key.PublicKey) {
+		t.Error("the keystore wasn't overwritten")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files, want only the keystore", len(entries))
+	}
+}